@@ -0,0 +1,92 @@
+package ghttp
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"sync"
+)
+
+// ErrSlowStream is returned by the body reader of a stream route if the
+// client sends more than streamBufferSize bytes ahead of the handler.
+var ErrSlowStream = errors.New("request body stream read too slowly")
+
+// streamBufferSize is the amount of unread body data buffered for a
+// stream route. The event loop can't stop reading from the connection,
+// the request fails instead if the handler falls further behind.
+const streamBufferSize = 4 << 20
+
+// bodyStream hands a request body arriving on the I/O loop
+// to a handler running outside of it.
+type bodyStream struct {
+	mu      sync.Mutex
+	cond    sync.Cond
+	buf     bytes.Buffer
+	done    bool
+	err     error
+	trailer []pair
+}
+
+func newBodyStream() *bodyStream {
+	s := &bodyStream{}
+	s.cond.L = &s.mu
+	return s
+}
+
+// write appends received body data to the stream,
+// it fails if too much of it is unread.
+func (s *bodyStream) write(p []byte) error {
+	s.mu.Lock()
+	if s.buf.Len()+len(p) > streamBufferSize {
+		s.mu.Unlock()
+		return ErrSlowStream
+	}
+	s.buf.Write(p)
+	s.mu.Unlock()
+	s.cond.Signal()
+	return nil
+}
+
+// finish marks the end of the body. A non nil err
+// is returned to the reader once the buffered data is consumed.
+func (s *bodyStream) finish(err error, trailer []pair) {
+	s.mu.Lock()
+	s.done = true
+	s.err = err
+	if len(trailer) > 0 {
+		c := httpParser{trailer: append([]pair(nil), trailer...)}
+		c.retain(nil)
+		s.trailer = c.trailer
+	}
+	s.mu.Unlock()
+	s.cond.Signal()
+}
+
+// Read reads body data and blocks until data is available
+// or the body has been received completely.
+func (s *bodyStream) Read(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for s.buf.Len() == 0 && !s.done {
+		s.cond.Wait()
+	}
+	if s.buf.Len() == 0 {
+		if s.err != nil {
+			return 0, s.err
+		}
+		return 0, io.EOF
+	}
+	return s.buf.Read(p)
+}
+
+// findTrailer returns the trailer value once the body has been read.
+func (s *bodyStream) findTrailer(name []byte) []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, pair := range s.trailer {
+		if bytes.EqualFold(pair[0], name) {
+			return pair[1]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,179 @@
+package ghttp
+
+import (
+	"bytes"
+	"errors"
+	"strconv"
+)
+
+// ErrBadChunk is returned when a chunked request body is malformed.
+var ErrBadChunk = errors.New("invalid chunked encoding")
+
+const (
+	chunkSize = iota
+	chunkData
+	chunkDataEnd
+	chunkTrailer
+	chunkDone
+)
+
+// maxChunkLine limits the length of chunk size and trailer lines.
+const maxChunkLine = 4096
+
+// chunkedDecoder decodes a body with chunked transfer encoding
+// which may arrive in any number of reads.
+type chunkedDecoder struct {
+	state     int
+	remaining int64
+	trailer   []byte
+	trailers  []pair
+}
+
+func (cd *chunkedDecoder) reset() {
+	cd.state = chunkSize
+	cd.remaining = 0
+	cd.trailer = cd.trailer[:0]
+	cd.trailers = cd.trailers[:0]
+}
+
+func (cd *chunkedDecoder) done() bool {
+	return cd.state == chunkDone
+}
+
+// maxChunkSizeDigits keeps chunk sizes far from overflowing.
+const maxChunkSizeDigits = 15
+
+// parseChunkSize parses the hex digits of a chunk size,
+// signs and prefixes aren't allowed.
+func parseChunkSize(size []byte) (int64, bool) {
+	if len(size) == 0 || len(size) > maxChunkSizeDigits {
+		return 0, false
+	}
+	var length int64
+	for _, c := range size {
+		digit, ok := unhex(c)
+		if !ok {
+			return 0, false
+		}
+		length = length<<4 | int64(digit)
+	}
+	return length, true
+}
+
+// line returns the length of the line at the start of data
+// including its line break or -1 if the line is incomplete.
+func line(data []byte) (int, error) {
+	i := bytes.IndexByte(data, '\n')
+	if i == -1 {
+		if len(data) > maxChunkLine {
+			return 0, ErrBadChunk
+		}
+		return -1, nil
+	}
+	if i == 0 || data[i-1] != '\r' {
+		return 0, ErrBadChunk
+	}
+	return i + 1, nil
+}
+
+// decode advances the decoder by one step over data.
+// It returns the number of bytes consumed and the decoded
+// body data contained in them.
+// No bytes are consumed if data does not hold enough
+// data to advance.
+func (cd *chunkedDecoder) decode(data []byte) (int, []byte, error) {
+	switch cd.state {
+	case chunkSize:
+		n, err := line(data)
+		if n <= 0 {
+			return 0, nil, err
+		}
+		size := data[:n-2]
+		if i := bytes.IndexByte(size, ';'); i != -1 {
+			size = size[:i]
+		}
+		size = bytes.TrimRight(size, " \t")
+		length, ok := parseChunkSize(size)
+		if !ok {
+			return 0, nil, ErrBadChunk
+		}
+		cd.remaining = length
+		cd.state = chunkData
+		if length == 0 {
+			cd.state = chunkTrailer
+		}
+		return n, nil, nil
+	case chunkData:
+		n := len(data)
+		if int64(n) > cd.remaining {
+			n = int(cd.remaining)
+		}
+		cd.remaining -= int64(n)
+		if cd.remaining == 0 {
+			cd.state = chunkDataEnd
+		}
+		return n, data[:n], nil
+	case chunkDataEnd:
+		if len(data) < 2 {
+			return 0, nil, nil
+		}
+		if data[0] != '\r' || data[1] != '\n' {
+			return 0, nil, ErrBadChunk
+		}
+		cd.state = chunkSize
+		return 2, nil, nil
+	case chunkTrailer:
+		n, err := line(data)
+		if n <= 0 {
+			return 0, nil, err
+		}
+		if n == 2 {
+			cd.state = chunkDone
+			return n, nil, nil
+		}
+		field := data[:n-2]
+		colon := bytes.IndexByte(field, ':')
+		if colon <= 0 {
+			return 0, nil, ErrBadChunk
+		}
+		if len(cd.trailer)+len(field) > maxChunkLine {
+			return 0, nil, ErrBadChunk
+		}
+		// the trailer buffer must not move while
+		// trailers point into it.
+		if cap(cd.trailer) < maxChunkLine {
+			cd.trailer = make([]byte, 0, maxChunkLine)
+		}
+		start := len(cd.trailer)
+		cd.trailer = append(cd.trailer, field...)
+		field = cd.trailer[start:]
+		name := field[:colon]
+		value := bytes.TrimLeft(field[colon+1:], " \t")
+		cd.trailers = append(cd.trailers, pair{name, value})
+		return n, nil, nil
+	}
+	return 0, nil, nil
+}
+
+// writeChunk writes p as one chunk into the buffer.
+func writeChunk(into *bytes.Buffer, p []byte) {
+	if len(p) == 0 {
+		return
+	}
+	into.WriteString(strconv.FormatInt(int64(len(p)), 16))
+	into.WriteString("\r\n")
+	into.Write(p)
+	into.WriteString("\r\n")
+}
+
+// writeLastChunk terminates a chunked body with the given trailers.
+func writeLastChunk(into *bytes.Buffer, trailers [][2]string) {
+	into.WriteString("0\r\n")
+	for _, trailer := range trailers {
+		into.WriteString(trailer[0])
+		into.WriteString(": ")
+		into.WriteString(trailer[1])
+		into.WriteString("\r\n")
+	}
+	into.WriteString("\r\n")
+}
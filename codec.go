@@ -11,9 +11,27 @@ type httpParser struct {
 	version       int
 	method        int
 	contentLength int64
+	chunked       bool
+	connClose     bool
+	connKeepAlive bool
 	path          []byte
 	query         []pair
+	queryDecoded  bool
 	header        []pair
+	trailer       []pair
+	// body is the complete body of the request.
+	body []byte
+	// targetRead is set once the request target is parsed.
+	targetRead bool
+	limits     parserLimits
+}
+
+// parserLimits bound the size of a request header,
+// a zero limit is unlimited.
+type parserLimits struct {
+	maxURILength   int
+	maxHeaderSize  int
+	maxHeaderCount int
 }
 
 // HTTP Methods
@@ -31,11 +49,16 @@ const (
 	methodCount
 )
 
+var methodNames = [methodCount]string{
+	"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE", "CONNECT", "OPTIONS", "TRACE", "",
+}
+
 // HTTP Protocoll
 const (
 	HTTP0_9 = iota
 	HTTP1_0
 	HTTP1_1
+	HTTP2_0
 )
 
 const (
@@ -88,6 +111,10 @@ func requestMethod(data []byte) int {
 	return MethodUnkown
 }
 
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
 func isHorSpace(c byte) bool {
 	return c == ' ' || c == '\t'
 }
@@ -96,14 +123,44 @@ var ErrIncompleteData = errors.New("incomplete http request")
 var ErrBadData = errors.New("invalid http request")
 var ErrUnsupportedMethod = errors.New("http method not supported")
 var ErrUnsupportedProtocol = errors.New("protocol not supported")
+var ErrURITooLong = errors.New("http request uri too long")
+var ErrHeaderTooLarge = errors.New("http request header too large")
+var ErrBodyTooLarge = errors.New("http request body too large")
+var ErrUnsupportedEncoding = errors.New("transfer coding not supported")
+var ErrTimeout = errors.New("http request timeout")
 
 var shortestRequestPossible = []byte("GET / HTTP/X.X\r\n\r\n")
 var minRequestSize = len(shortestRequestPossible)
 
+// Parse parses the request header in content and returns its length.
+// ErrURITooLong or ErrHeaderTooLarge are returned if the header exceeds
+// the limits of the parser.
 func (hp *httpParser) Parse(content []byte) (int, error) {
+	truncated := false
+	if hp.limits.maxHeaderSize > 0 && len(content) > hp.limits.maxHeaderSize {
+		content = content[:hp.limits.maxHeaderSize]
+		truncated = true
+	}
+	n, err := hp.parse(content)
+	if err == ErrIncompleteData && truncated {
+		if !hp.targetRead {
+			return 0, ErrURITooLong
+		}
+		return 0, ErrHeaderTooLarge
+	}
+	return n, err
+}
+
+func (hp *httpParser) parse(content []byte) (int, error) {
+	hp.targetRead = false
 	hp.contentLength = -1
+	hp.chunked = false
+	hp.connClose = false
+	hp.connKeepAlive = false
 	hp.query = hp.query[:0]
+	hp.queryDecoded = false
 	hp.header = hp.header[:0]
+	hp.trailer = nil
 	if len(content) < minRequestSize {
 		return 0, ErrIncompleteData
 	}
@@ -137,35 +194,49 @@ func (hp *httpParser) Parse(content []byte) (int, error) {
 	}
 	queryPathEnd := reader
 	hp.path = content[queryPathStart:queryPathEnd]
-	if content[reader] == '?' && reader < len(content)-1 {
-		for !isHorSpace(content[reader]) {
-			reader++
+	if content[reader] == '?' {
+		reader++
+		for reader < length && !isHorSpace(content[reader]) {
 			paramNameStart := reader
-			for reader < length && !isHorSpace(content[reader]) && content[reader] != '=' {
+			for reader < length && !isHorSpace(content[reader]) && content[reader] != '=' && content[reader] != '&' {
 				reader++
 			}
-
 			if reader == length {
 				return 0, ErrIncompleteData
 			}
 			paramNameEnd := reader
-			reader++
-			paramValStart := reader
-			for reader < length && !isHorSpace(content[reader]) && content[reader] != '&' {
+			paramValStart, paramValEnd := reader, reader
+			if content[reader] == '=' {
 				reader++
+				paramValStart = reader
+				for reader < length && !isHorSpace(content[reader]) && content[reader] != '&' {
+					reader++
+				}
+				if reader == length {
+					return 0, ErrIncompleteData
+				}
+				paramValEnd = reader
 			}
-			if reader == length {
-				return 0, ErrIncompleteData
+			if paramNameEnd > paramNameStart || paramValEnd > paramValStart {
+				name := content[paramNameStart:paramNameEnd]
+				val := content[paramValStart:paramValEnd]
+				hp.query = append(hp.query, pair{name, val})
+			}
+			if content[reader] == '&' {
+				reader++
 			}
-			paramValEnd := reader
-			name := content[paramNameStart:paramNameEnd]
-			val := content[paramValStart:paramValEnd]
-			hp.query = append(hp.query, pair{name, val})
 		}
 	}
 	for reader < length && !isHorSpace(content[reader]) {
 		reader++
 	}
+	if reader == length {
+		return 0, ErrIncompleteData
+	}
+	hp.targetRead = true
+	if hp.limits.maxURILength > 0 && reader-queryPathStart > hp.limits.maxURILength {
+		return 0, ErrURITooLong
+	}
 	if length < reader+6 {
 		return 0, ErrIncompleteData
 	}
@@ -177,7 +248,7 @@ func (hp *httpParser) Parse(content []byte) (int, error) {
 	for reader < length && content[reader] != '\r' {
 		reader++
 	}
-	if length < reader+1 {
+	if length < reader+2 {
 		return 0, ErrIncompleteData
 	}
 	if content[reader] != '\r' || content[reader+1] != '\n' {
@@ -191,17 +262,28 @@ func (hp *httpParser) Parse(content []byte) (int, error) {
 		hp.version = HTTP1_0
 	} else if string(version) == "1.1" {
 		hp.version = HTTP1_1
+	} else if len(version) == 3 && isDigit(version[0]) && version[1] == '.' && isDigit(version[2]) {
+		return 0, ErrUnsupportedProtocol
 	} else {
-		return 0, ErrUnsupportedMethod
+		return 0, ErrBadData
 	}
 	reader += 2
-	breakEaten := false
 	for reader < length && content[reader] != '\r' {
 		paramNameStart := reader
 		for reader < length && content[reader] != ':' {
+			if content[reader] == '\r' || content[reader] == '\n' || isHorSpace(content[reader]) {
+				// a line without colon or whitespace in the name.
+				return 0, ErrBadData
+			}
 			reader++
 		}
+		if reader == length {
+			return 0, ErrIncompleteData
+		}
 		paramNameEnd := reader
+		if paramNameEnd == paramNameStart {
+			return 0, ErrBadData
+		}
 		reader++
 		for reader < length && isHorSpace(content[reader]) {
 			reader++
@@ -218,38 +300,168 @@ func (hp *httpParser) Parse(content []byte) (int, error) {
 		}
 		paramValEnd := reader
 		reader++
+		if reader == length {
+			return 0, ErrIncompleteData
+		}
 		if content[reader] != '\n' {
 			return 0, ErrBadData
 		}
 		reader++
-		breakEaten = true
 		name := content[paramNameStart:paramNameEnd]
 		val := content[paramValStart:paramValEnd]
 		if bytes.EqualFold(contentLength, name) {
-			hp.contentLength = BytesToInt(val)
+			n, err := parseContentLength(bytes.TrimRight(val, " \t"))
+			if err != nil {
+				return 0, err
+			}
+			if hp.contentLength >= 0 && hp.contentLength != n {
+				// conflicting lengths allow request smuggling.
+				return 0, ErrBadData
+			}
+			hp.contentLength = n
+		} else if bytes.EqualFold(connection, name) {
+			hp.connectionOptions(val)
+		} else if bytes.EqualFold(transferEncoding, name) {
+			if hp.chunked {
+				// chunked must be applied only once.
+				return 0, ErrBadData
+			}
+			if !isChunked(val) {
+				return 0, ErrUnsupportedEncoding
+			}
+			hp.chunked = true
+		}
+		if hp.limits.maxHeaderCount > 0 && len(hp.header) == hp.limits.maxHeaderCount {
+			return 0, ErrHeaderTooLarge
 		}
 		hp.header = append(hp.header, pair{name, val})
 	}
-	if reader == length {
+	if length < reader+2 {
 		return 0, ErrIncompleteData
 	}
-	if !breakEaten {
-		if length < reader+4 {
-			return 0, ErrIncompleteData
-		}
-		if content[reader] != '\r' || content[reader+1] != '\n' || content[reader+2] != '\r' || content[reader+3] != '\n' {
+	if content[reader] != '\r' || content[reader+1] != '\n' {
+		return 0, ErrBadData
+	}
+	if hp.chunked && hp.contentLength >= 0 {
+		// the framing is ambiguous, which allows request smuggling.
+		return 0, ErrBadData
+	}
+	return reader + 2, nil
+}
+
+// maxContentLength is the largest accepted Content-Length, lengths
+// near the int limit would overflow offsets into the body.
+const maxContentLength = 1 << 40
+
+// parseContentLength parses a Content-Length value, it has to be digits
+// only. Lengths above maxContentLength return ErrBodyTooLarge.
+func parseContentLength(val []byte) (int64, error) {
+	if len(val) == 0 {
+		return 0, ErrBadData
+	}
+	var n int64
+	for _, b := range val {
+		if !isDigit(b) {
 			return 0, ErrBadData
 		}
-		return reader + 4, nil
+		n = n*10 + int64(b-'0')
+		if n > maxContentLength {
+			return 0, ErrBodyTooLarge
+		}
+	}
+	return n, nil
+}
 
+var connection = []byte("Connection")
+var connectionClose = []byte("close")
+var connectionKeepAlive = []byte("keep-alive")
+
+// connectionOptions reads the close and keep-alive
+// options of a Connection header.
+func (hp *httpParser) connectionOptions(val []byte) {
+	for len(val) > 0 {
+		option := val
+		if i := bytes.IndexByte(val, ','); i != -1 {
+			option, val = val[:i], val[i+1:]
+		} else {
+			val = nil
+		}
+		option = bytes.Trim(option, " \t")
+		if bytes.EqualFold(option, connectionClose) {
+			hp.connClose = true
+		} else if bytes.EqualFold(option, connectionKeepAlive) {
+			hp.connKeepAlive = true
+		}
 	}
-	if length < reader+2 {
-		return 0, ErrIncompleteData
+}
+
+// hasToken reports whether the comma separated list
+// contains the token ignoring case.
+func hasToken(list []byte, token []byte) bool {
+	for len(list) > 0 {
+		element := list
+		if i := bytes.IndexByte(list, ','); i != -1 {
+			element, list = list[:i], list[i+1:]
+		} else {
+			list = nil
+		}
+		if bytes.EqualFold(bytes.Trim(element, " \t"), token) {
+			return true
+		}
 	}
-	if content[reader] != '\r' || content[reader+1] != '\n' {
-		return 0, ErrBadData
+	return false
+}
+
+// keepAlive reports whether the connection persists
+// after the request as defined in RFC 9112 section 9.3.
+func (hp *httpParser) keepAlive() bool {
+	if hp.connClose {
+		return false
 	}
-	return reader + 2, nil
+	return hp.version == HTTP1_1 || hp.version == HTTP1_0 && hp.connKeepAlive
+}
+
+var transferEncoding = []byte("Transfer-Encoding")
+var chunked = []byte("chunked")
+
+// isChunked reports whether the Transfer-Encoding value is chunked,
+// other transfer codings aren't supported.
+func isChunked(val []byte) bool {
+	return bytes.EqualFold(bytes.TrimRight(val, " \t"), chunked)
+}
+
+// decodeQuery percent decodes the query pairs in place
+// the first time they are accessed.
+func (hp *httpParser) decodeQuery() {
+	if hp.queryDecoded {
+		return
+	}
+	hp.queryDecoded = true
+	for i, p := range hp.query {
+		hp.query[i] = pair{unescapeQuery(p[0]), unescapeQuery(p[1])}
+	}
+}
+
+// FindQuery returns the decoded value of the first query
+// parameter with the given name.
+func (hp *httpParser) FindQuery(name []byte) ([]byte, bool) {
+	hp.decodeQuery()
+	for _, pair := range hp.query {
+		if bytes.Equal(pair[0], name) {
+			return pair[1], true
+		}
+	}
+	return nil, false
+}
+
+// FindTrailer returns the value of a trailer sent after a chunked body.
+func (hp *httpParser) FindTrailer(trailer []byte) []byte {
+	for _, pair := range hp.trailer {
+		if bytes.EqualFold(pair[0], trailer) {
+			return pair[1]
+		}
+	}
+	return nil
 }
 
 func (hp *httpParser) FindHeader(header []byte) []byte {
@@ -260,3 +472,59 @@ func (hp *httpParser) FindHeader(header []byte) []byte {
 	}
 	return nil
 }
+
+// retain copies the parsed request into buf, growing it if needed,
+// so it stays valid after the connection buffer has been reused.
+// The returned slice should be passed in again to reuse its memory.
+func (hp *httpParser) retain(buf []byte) []byte {
+	size := len(hp.path)
+	for _, p := range hp.query {
+		size += len(p[0]) + len(p[1])
+	}
+	for _, p := range hp.header {
+		size += len(p[0]) + len(p[1])
+	}
+	for _, p := range hp.trailer {
+		size += len(p[0]) + len(p[1])
+	}
+	if cap(buf) < size {
+		buf = make([]byte, 0, size)
+	}
+	buf = buf[:0]
+	own := func(b []byte) []byte {
+		start := len(buf)
+		buf = append(buf, b...)
+		return buf[start:len(buf):len(buf)]
+	}
+	hp.path = own(hp.path)
+	for i, p := range hp.query {
+		hp.query[i] = pair{own(p[0]), own(p[1])}
+	}
+	for i, p := range hp.header {
+		hp.header[i] = pair{own(p[0]), own(p[1])}
+	}
+	for i, p := range hp.trailer {
+		hp.trailer[i] = pair{own(p[0]), own(p[1])}
+	}
+	return buf
+}
+
+// clone returns a copy of the parsed request owning its memory.
+func (hp *httpParser) clone() *httpParser {
+	c := &httpParser{
+		version:       hp.version,
+		method:        hp.method,
+		contentLength: hp.contentLength,
+		chunked:       hp.chunked,
+		connClose:     hp.connClose,
+		connKeepAlive: hp.connKeepAlive,
+		queryDecoded:  hp.queryDecoded,
+		path:          hp.path,
+		query:         append([]pair(nil), hp.query...),
+		header:        append([]pair(nil), hp.header...),
+		trailer:       append([]pair(nil), hp.trailer...),
+		body:          CopyBytes(hp.body),
+	}
+	c.retain(nil)
+	return c
+}
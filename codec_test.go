@@ -6,6 +6,7 @@ import (
 	"bufio"
 	"bytes"
 	"net/http"
+	"strings"
 	"testing"
 )
 
@@ -129,3 +130,174 @@ func TestFindHeaderIgnoresCase(t *testing.T) {
 
 	assert(t, bytes.Equal([]byte("50"), hp.FindHeader([]byte("content-length"))))
 }
+
+var chunkedHeaders = []byte("POST / HTTP/1.1\r\nTransfer-Encoding: Chunked\r\n\r\n")
+
+func TestParseChunked(t *testing.T) {
+	hp := NewHTTPParser()
+
+	_, err := hp.Parse(chunkedHeaders)
+	noError(t, err)
+
+	assert(t, hp.chunked)
+	assert(t, hp.contentLength == -1)
+
+	for _, encoding := range []string{"gzip", "gzip, chunked", "chunked, gzip", "identity"} {
+		_, err = hp.Parse([]byte("POST / HTTP/1.1\r\nTransfer-Encoding: " + encoding + "\r\n\r\n"))
+		assert(t, err == ErrUnsupportedEncoding)
+	}
+
+	// ambiguous framing allows request smuggling.
+	_, err = hp.Parse([]byte("POST / HTTP/1.1\r\nContent-Length: 5\r\nTransfer-Encoding: chunked\r\n\r\n"))
+	assert(t, err == ErrBadData)
+	_, err = hp.Parse([]byte("POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\nContent-Length: 5\r\n\r\n"))
+	assert(t, err == ErrBadData)
+	_, err = hp.Parse([]byte("POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\nTransfer-Encoding: chunked\r\n\r\n"))
+	assert(t, err == ErrBadData)
+}
+
+func TestChunkedDecoder(t *testing.T) {
+	body := []byte("5;ext=1\r\nhello\r\n7\r\n, world\r\n0\r\nChecksum: abc\r\n\r\n")
+	// feed the body in every possible split
+	for split := 0; split <= len(body); split++ {
+		cd := chunkedDecoder{}
+		cd.reset()
+		decoded := []byte{}
+		reads := [][]byte{body[:split], body[split:]}
+		pending := []byte{}
+		for _, read := range reads {
+			pending = append(pending, read...)
+			for !cd.done() {
+				n, part, err := cd.decode(pending)
+				noError(t, err)
+				if n == 0 {
+					break
+				}
+				decoded = append(decoded, part...)
+				pending = pending[n:]
+			}
+		}
+		assert(t, cd.done())
+		assert(t, string(decoded) == "hello, world")
+		assert(t, len(cd.trailers) == 1)
+		assert(t, string(cd.trailers[0][1]) == "abc")
+	}
+}
+
+func TestChunkedDecoderInvalid(t *testing.T) {
+	cd := chunkedDecoder{}
+	cd.reset()
+	_, _, err := cd.decode([]byte("xyz\r\n"))
+	assert(t, err == ErrBadChunk)
+
+	for _, size := range []string{"-1", "+5", "0x5", " 5", "1000000000000000", "ffffffffffffffff"} {
+		cd.reset()
+		_, _, err = cd.decode([]byte(size + "\r\nabc"))
+		if err != ErrBadChunk {
+			t.Fatalf("%q: expected ErrBadChunk got %v", size, err)
+		}
+	}
+}
+
+var queryRequest = []byte("GET /search?q=hello+world&tag=a%2Fb&flag&tag=c&=x&empty= HTTP/1.1\r\n\r\n")
+
+func TestParseQuery(t *testing.T) {
+	hp := NewHTTPParser()
+
+	_, err := hp.Parse(queryRequest)
+	noError(t, err)
+
+	assert(t, bytes.Equal([]byte("/search"), hp.path))
+	assert(t, len(hp.query) == 6)
+	value, ok := hp.FindQuery([]byte("q"))
+	assert(t, ok && string(value) == "hello world")
+	value, ok = hp.FindQuery([]byte("tag"))
+	assert(t, ok && string(value) == "a/b")
+	value, ok = hp.FindQuery([]byte("flag"))
+	assert(t, ok && len(value) == 0)
+	_, ok = hp.FindQuery([]byte("missing"))
+	assert(t, !ok)
+}
+
+func TestUnescapeQuery(t *testing.T) {
+	for in, out := range map[string]string{
+		"a%20b":     "a b",
+		"a+b":       "a b",
+		"%zz":       "%zz",
+		"100%":      "100%",
+		"%4":        "%4",
+		"%e2%82%ac": "€",
+	} {
+		assert(t, string(unescapeQuery([]byte(in))) == out)
+	}
+}
+
+func TestParseLimits(t *testing.T) {
+	hp := NewHTTPParser()
+	hp.limits = parserLimits{maxURILength: 8, maxHeaderSize: 64, maxHeaderCount: 2}
+
+	_, err := hp.Parse([]byte("GET /too/long/path HTTP/1.1\r\n\r\n"))
+	assert(t, err == ErrURITooLong)
+
+	_, err = hp.Parse([]byte("GET /" + strings.Repeat("a", 64)))
+	assert(t, err == ErrURITooLong)
+
+	_, err = hp.Parse([]byte("GET / HTTP/1.1\r\nA: 1\r\nB: 2\r\nC: 3\r\n\r\n"))
+	assert(t, err == ErrHeaderTooLarge)
+
+	_, err = hp.Parse([]byte("GET / HTTP/1.1\r\nA: " + strings.Repeat("a", 64)))
+	assert(t, err == ErrHeaderTooLarge)
+
+	_, err = hp.Parse([]byte("GET / HTTP/1.1\r\nA: 1\r\nB: 2\r\n\r\n"))
+	noError(t, err)
+}
+
+func TestParseErrors(t *testing.T) {
+	hp := NewHTTPParser()
+
+	_, err := hp.Parse([]byte("BREW / HTTP/1.1\r\n\r\n"))
+	assert(t, err == ErrUnsupportedMethod)
+
+	_, err = hp.Parse([]byte("GET / HTTP/2.0\r\n\r\n"))
+	assert(t, err == ErrUnsupportedProtocol)
+
+	_, err = hp.Parse([]byte("GET / HTTP/one\r\n\r\n"))
+	assert(t, err == ErrBadData)
+
+	_, err = hp.Parse([]byte("GET / HTTX/1.1\r\n\r\n"))
+	assert(t, err == ErrBadData)
+}
+
+func TestParseMalformedHeader(t *testing.T) {
+	hp := NewHTTPParser()
+	for _, header := range []string{
+		"BadHeader\r\n",
+		"BadHeader\r\nA: 1\r\n",
+		": empty\r\n",
+		"Bad Header: 1\r\n",
+		"Bad\tHeader: 1\r\n",
+		"Content-Length: -1\r\n",
+		"Content-Length: 1e3\r\n",
+		"Content-Length: \r\n",
+		"Content-Length: 5\r\nContent-Length: 6\r\n",
+	} {
+		_, err := hp.Parse([]byte("POST / HTTP/1.1\r\n" + header + "\r\n"))
+		if err != ErrBadData {
+			t.Fatalf("%q: expected ErrBadData got %v", header, err)
+		}
+	}
+
+	for _, length := range []string{"18446744073709551614", "18446744073709551615", "9223372036854775808", "9223372036854775799", "1099511627777"} {
+		_, err := hp.Parse([]byte("POST / HTTP/1.1\r\nContent-Length: " + length + "\r\n\r\n"))
+		if err != ErrBodyTooLarge {
+			t.Fatalf("%s: expected ErrBodyTooLarge got %v", length, err)
+		}
+	}
+
+	_, err := hp.Parse([]byte("POST / HTTP/1.1\r\nContent-Length: 5\r\ncontent-length: 5 \r\n\r\n"))
+	noError(t, err)
+	assert(t, hp.contentLength == 5)
+
+	_, err = hp.Parse([]byte("POST / HTTP/1.1\r\nContent-Len"))
+	assert(t, err == ErrIncompleteData)
+}
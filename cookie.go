@@ -0,0 +1,201 @@
+package ghttp
+
+import (
+	"bytes"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var cookieHeader = []byte("Cookie")
+
+// Cookie returns the value of the first cookie name sent by the client
+// or an empty string if it isn't present.
+//
+// To keep this value longer than the request use CopyString.
+func (r Request) Cookie(name string) string {
+	var found []byte
+	r.visitCookies(func(key, value []byte) bool {
+		if string(key) == name {
+			found = value
+			return false
+		}
+		return true
+	})
+	return *unsafeString(&found)
+}
+
+// VisitCookies calls fn for every cookie sent by the client in the
+// order they appear in the request until fn returns false.
+//
+// To keep the values longer than the request use CopyString.
+func (r Request) VisitCookies(fn func(name, value string) bool) {
+	r.visitCookies(func(name, value []byte) bool {
+		return fn(*unsafeString(&name), *unsafeString(&value))
+	})
+}
+
+// visitCookies parses the Cookie fields of the header, clients
+// may send multiple ones.
+func (r Request) visitCookies(fn func(name, value []byte) bool) {
+	for _, header := range r.parser.header {
+		if !bytes.EqualFold(header[0], cookieHeader) {
+			continue
+		}
+		list := header[1]
+		for len(list) > 0 {
+			cookie := list
+			list = nil
+			if i := bytes.IndexByte(cookie, ';'); i >= 0 {
+				cookie, list = cookie[:i], cookie[i+1:]
+			}
+			cookie = bytes.TrimSpace(cookie)
+			i := bytes.IndexByte(cookie, '=')
+			if i <= 0 {
+				continue
+			}
+			name, value := cookie[:i], cookie[i+1:]
+			if len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"' {
+				value = value[1 : len(value)-1]
+			}
+			if !fn(name, value) {
+				return
+			}
+		}
+	}
+}
+
+// SameSite is the SameSite attribute of a cookie.
+type SameSite int
+
+const (
+	// SameSiteDefault omits the attribute.
+	SameSiteDefault SameSite = iota
+	SameSiteLax
+	SameSiteStrict
+	SameSiteNone
+)
+
+// Cookie is a cookie sent with Response.SetCookie.
+type Cookie struct {
+	Name  string
+	Value string
+	// Path and Domain are omitted if empty.
+	Path   string
+	Domain string
+	// Expires is omitted if zero.
+	Expires time.Time
+	// MaxAge is omitted if zero, a negative
+	// MaxAge deletes the cookie immediately.
+	MaxAge   int
+	Secure   bool
+	HttpOnly bool
+	SameSite SameSite
+	// Partitioned stores the cookie per top-level site (CHIPS),
+	// browsers require Secure with it.
+	Partitioned bool
+}
+
+// SetCookie adds a Set-Cookie header for the cookie. Cookies with
+// an invalid name are ignored, invalid bytes of the value and
+// attributes are removed.
+func (r *Response) SetCookie(cookie Cookie) *Response {
+	if value := cookie.String(); value != "" {
+		r.AddHeader([2]string{"Set-Cookie", value})
+	}
+	return r
+}
+
+// String returns the cookie formatted as the value of a Set-Cookie header.
+// It is empty if the name is invalid.
+func (c Cookie) String() string {
+	if c.Name == "" || !isCookieToken(c.Name) {
+		return ""
+	}
+	b := make([]byte, 0, len(c.Name)+len(c.Value)+len(c.Path)+len(c.Domain)+64)
+	b = append(b, c.Name...)
+	b = append(b, '=')
+	value := sanitize(c.Value, isCookieValueByte)
+	if strings.ContainsAny(value, " ,") {
+		b = append(b, '"')
+		b = append(b, value...)
+		b = append(b, '"')
+	} else {
+		b = append(b, value...)
+	}
+	if c.Path != "" {
+		b = append(b, "; Path="...)
+		b = append(b, sanitize(c.Path, isCookieAttributeByte)...)
+	}
+	if c.Domain != "" {
+		b = append(b, "; Domain="...)
+		b = append(b, sanitize(c.Domain, isCookieAttributeByte)...)
+	}
+	if !c.Expires.IsZero() {
+		b = append(b, "; Expires="...)
+		b = c.Expires.UTC().AppendFormat(b, http.TimeFormat)
+	}
+	if c.MaxAge > 0 {
+		b = append(b, "; Max-Age="...)
+		b = strconv.AppendInt(b, int64(c.MaxAge), 10)
+	} else if c.MaxAge < 0 {
+		b = append(b, "; Max-Age=0"...)
+	}
+	if c.HttpOnly {
+		b = append(b, "; HttpOnly"...)
+	}
+	if c.Secure {
+		b = append(b, "; Secure"...)
+	}
+	switch c.SameSite {
+	case SameSiteLax:
+		b = append(b, "; SameSite=Lax"...)
+	case SameSiteStrict:
+		b = append(b, "; SameSite=Strict"...)
+	case SameSiteNone:
+		b = append(b, "; SameSite=None"...)
+	}
+	if c.Partitioned {
+		b = append(b, "; Partitioned"...)
+	}
+	return string(b)
+}
+
+// sanitize removes the bytes of s which aren't valid.
+func sanitize(s string, valid func(b byte) bool) string {
+	for i := 0; i < len(s); i++ {
+		if valid(s[i]) {
+			continue
+		}
+		b := make([]byte, 0, len(s))
+		for j := 0; j < len(s); j++ {
+			if valid(s[j]) {
+				b = append(b, s[j])
+			}
+		}
+		return string(b)
+	}
+	return s
+}
+
+// isCookieToken reports whether the name is an RFC 6265 token.
+func isCookieToken(name string) bool {
+	for i := 0; i < len(name); i++ {
+		b := name[i]
+		if b <= ' ' || b >= 0x7f || strings.IndexByte(`()<>@,;:\"/[]?={}`, b) >= 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// isCookieValueByte reports whether b may be used in a cookie value,
+// spaces and commas are allowed in quoted values.
+func isCookieValueByte(b byte) bool {
+	return b >= ' ' && b < 0x7f && b != '"' && b != ';' && b != '\\'
+}
+
+func isCookieAttributeByte(b byte) bool {
+	return b >= ' ' && b < 0x7f && b != ';'
+}
@@ -0,0 +1,54 @@
+package ghttp
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRequestCookie(t *testing.T) {
+	req := parsedRequest(t, "GET / HTTP/1.1\r\nCookie: session=abc; theme=\"dark\"\r\nX-Other: a=b\r\ncookie: lang=de; empty=; =skipped\r\n\r\n")
+	assert(t, req.Cookie("session") == "abc")
+	assert(t, req.Cookie("theme") == "dark")
+	assert(t, req.Cookie("lang") == "de")
+	assert(t, req.Cookie("empty") == "")
+	assert(t, req.Cookie("a") == "")
+	assert(t, req.Cookie("missing") == "")
+
+	names := ""
+	req.VisitCookies(func(name, value string) bool {
+		names += name + ","
+		return name != "lang"
+	})
+	assert(t, names == "session,theme,lang,")
+
+	allocs := testing.AllocsPerRun(100, func() {
+		req.Cookie("lang")
+	})
+	assert(t, allocs == 0)
+}
+
+func TestSetCookie(t *testing.T) {
+	res := &Response{}
+	res.SetCookie(Cookie{Name: "session", Value: "abc"})
+	res.SetCookie(Cookie{
+		Name:        "id",
+		Value:       "a b",
+		Path:        "/app;evil",
+		Domain:      "example.com",
+		Expires:     time.Date(2030, 1, 2, 3, 4, 5, 0, time.FixedZone("CET", 3600)),
+		MaxAge:      3600,
+		Secure:      true,
+		HttpOnly:    true,
+		SameSite:    SameSiteStrict,
+		Partitioned: true,
+	})
+	res.SetCookie(Cookie{Name: "old", MaxAge: -1, SameSite: SameSiteNone})
+	res.SetCookie(Cookie{Name: "in valid", Value: "x"})
+	res.SetCookie(Cookie{Name: "q", Value: "a\"b;c\\d", SameSite: SameSiteLax})
+
+	assert(t, len(res.headers) == 4)
+	assert(t, res.headers[0] == [2]string{"Set-Cookie", "session=abc"})
+	assert(t, res.headers[1][1] == `id="a b"; Path=/appevil; Domain=example.com; Expires=Wed, 02 Jan 2030 02:04:05 GMT; Max-Age=3600; HttpOnly; Secure; SameSite=Strict; Partitioned`)
+	assert(t, res.headers[2][1] == "old=; Max-Age=0; SameSite=None")
+	assert(t, res.headers[3][1] == "q=abcd; SameSite=Lax")
+}
@@ -0,0 +1,129 @@
+package ghttp
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"runtime/debug"
+)
+
+// HTTPError is an error answered with its status, message and headers.
+// Return it from a HandlerFunc to respond with a specific status:
+//
+//	return ghttp.Error(400, "bad id")
+type HTTPError struct {
+	Status  int
+	Message string
+	Headers [][2]string
+}
+
+// Error creates an HTTPError with the status and message.
+// If the message is empty the status text is used.
+func Error(status int, message string) *HTTPError {
+	if message == "" {
+		message = http.StatusText(status)
+	}
+	return &HTTPError{Status: status, Message: message}
+}
+
+// AddHeader adds the key value pair of {key value} to the header of the response.
+func (e *HTTPError) AddHeader(header [2]string) *HTTPError {
+	e.Headers = append(e.Headers, header)
+	return e
+}
+
+func (e *HTTPError) Error() string {
+	return e.Message
+}
+
+// ErrorHandlerFunc answers errors returned by a HandlerFunc.
+// The headers, body and trailers written by the handler are
+// discarded and the status set to 500 before it is called.
+type ErrorHandlerFunc = func(req Request, res *Response, err error)
+
+// DefaultErrorHandler answers an HTTPError with its status, message and headers
+// and any other error with "Internal Server Error".
+func DefaultErrorHandler(req Request, res *Response, err error) {
+	var httpErr *HTTPError
+	if !errors.As(err, &httpErr) {
+		res.WriteString("Internal Server Error")
+		return
+	}
+	res.Status(httpErr.Status)
+	for _, header := range httpErr.Headers {
+		res.AddHeader(header)
+	}
+	res.WriteString(httpErr.Message)
+}
+
+// RejectHandlerFunc observes requests which are rejected before they are routed,
+// such as malformed requests or requests exceeding the limits of the server.
+// The status is answered and the connection closed after it returns.
+// It is called on the event loop and must not block.
+type RejectHandlerFunc = func(remoteAddr net.Addr, status int, err error)
+
+// rejectStatus is the status answered for a rejected request.
+func rejectStatus(err error) int {
+	switch err {
+	case ErrUnsupportedMethod, ErrUnsupportedEncoding:
+		return http.StatusNotImplemented
+	case ErrUnsupportedProtocol:
+		return http.StatusHTTPVersionNotSupported
+	case ErrURITooLong:
+		return http.StatusRequestURITooLong
+	case ErrHeaderTooLarge:
+		return http.StatusRequestHeaderFieldsTooLarge
+	case ErrBodyTooLarge:
+		return http.StatusRequestEntityTooLarge
+	case ErrTimeout:
+		return http.StatusRequestTimeout
+	}
+	return http.StatusBadRequest
+}
+
+// PanicError is passed to the error handler when a handler panics.
+type PanicError struct {
+	Value any
+	Stack []byte
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprint("panic: ", e.Value)
+}
+
+// recovered logs the panic v and wraps it into a PanicError.
+func recovered(req Request, v any) *PanicError {
+	err := &PanicError{Value: v, Stack: debug.Stack()}
+	req.codec.server.options.Logger.Errorf("ghttp: panic serving %s: %v\n%s", req.Path(), v, err.Stack)
+	return err
+}
+
+// serve runs the handler and turns a panic into an error.
+func (router *Router) serve(handler HandlerFunc, req Request, res *Response) (err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			err = recovered(req, v)
+		}
+	}()
+	return handler(req, res)
+}
+
+// handleError resets the response and passes err to the error handler.
+func (router *Router) handleError(req Request, res *Response, err error) {
+	res.status = 500
+	res.headers = res.headers[:0]
+	res.body.Reset()
+	res.chunked = false
+	res.trailers = res.trailers[:0]
+	defer func() {
+		if v := recover(); v != nil {
+			recovered(req, v)
+			res.status = 500
+			res.headers = res.headers[:0]
+			res.body.Reset()
+			res.WriteString("Internal Server Error")
+		}
+	}()
+	router.errorHandler(req, res, err)
+}
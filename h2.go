@@ -0,0 +1,935 @@
+package ghttp
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+
+	"github.com/panjf2000/gnet/v2"
+)
+
+// http2Preface is sent by HTTP/2 clients before the first frame.
+const http2Preface = "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"
+
+// HTTP/2 frame types
+const (
+	frameData         = 0x0
+	frameHeaders      = 0x1
+	framePriority     = 0x2
+	frameRSTStream    = 0x3
+	frameSettings     = 0x4
+	framePushPromise  = 0x5
+	framePing         = 0x6
+	frameGoAway       = 0x7
+	frameWindowUpdate = 0x8
+	frameContinuation = 0x9
+)
+
+// HTTP/2 frame flags
+const (
+	flagEndStream  = 0x1
+	flagAck        = 0x1
+	flagEndHeaders = 0x4
+	flagPadded     = 0x8
+	flagPriority   = 0x20
+)
+
+// HTTP/2 error codes
+const (
+	h2NoError          = 0x0
+	h2ProtocolError    = 0x1
+	h2InternalError    = 0x2
+	h2FlowControlError = 0x3
+	h2StreamClosed     = 0x5
+	h2FrameSizeError   = 0x6
+	h2RefusedStream    = 0x7
+	h2CompressionError = 0x9
+	h2EnhanceYourCalm  = 0xb
+)
+
+const (
+	h2FrameHeaderLength = 9
+	h2MaxWindow         = math.MaxInt32
+	h2DefaultWindow     = 65535
+	// h2DefaultFrameSize is also the largest frame accepted by the server.
+	h2DefaultFrameSize     = 16384
+	h2MaxFrameSizeLimit    = 1<<24 - 1
+	h2HeaderTableSize      = 4096
+	h2MaxConcurrentStreams = 250
+)
+
+// HTTP/2 settings
+const (
+	settingHeaderTableSize      = 0x1
+	settingEnablePush           = 0x2
+	settingMaxConcurrentStreams = 0x3
+	settingInitialWindowSize    = 0x4
+	settingMaxFrameSize         = 0x5
+	settingMaxHeaderListSize    = 0x6
+)
+
+// h2Conn is the codec of an HTTP/2 connection. It is only
+// used on the event loop of the connection.
+type h2Conn struct {
+	hs      *httpServer
+	conn    gnet.Conn
+	codec   *httpCodec
+	decoder *hpackDecoder
+	// preface is set once the client preface is read.
+	preface bool
+	streams map[uint32]*h2Stream
+	// lastStream is the highest stream opened by the client.
+	lastStream uint32
+	// headers is the stream of the header block which
+	// continues in CONTINUATION frames.
+	headers   *h2Stream
+	block     []byte
+	endStream bool
+	// upgrade is the stream of the request which
+	// upgraded the connection to h2c.
+	upgrade *h2Stream
+	// settings of the client.
+	maxFrameSize  int
+	initialWindow int64
+	sendWindow    int64
+	goAway        bool
+	closing       bool
+	out           bytes.Buffer
+	// scratch buffers to build request headers.
+	fields  []byte
+	cookies []byte
+	pseudo  h2Pseudo
+}
+
+// h2Pseudo collects the pseudo headers of a request.
+type h2Pseudo struct {
+	method, path, authority, scheme []byte
+	regular                         bool
+}
+
+// h2Stream is a request and its response on an HTTP/2 connection.
+type h2Stream struct {
+	id      uint32
+	conn    *h2Conn
+	parser  *httpParser
+	head    []byte
+	body    []byte
+	trailer []pair
+	// remoteDone is set once the request is complete.
+	remoteDone bool
+	// dispatched is set once the request is routed,
+	// later data is ignored.
+	dispatched bool
+	reset      bool
+	// sendWindow is the flow control window of the client.
+	sendWindow int64
+	// pending is the response data waiting for the flow control window,
+	// it ends the stream with trailers if pendingEnd is set.
+	pending    []byte
+	pendingEnd bool
+	trailers   [][2]string
+	sentEnd    bool
+}
+
+func newH2Conn(hs *httpServer, c gnet.Conn, hc *httpCodec) *h2Conn {
+	return &h2Conn{
+		hs:            hs,
+		conn:          c,
+		codec:         hc,
+		decoder:       newHpackDecoder(h2HeaderTableSize),
+		streams:       map[uint32]*h2Stream{},
+		maxFrameSize:  h2DefaultFrameSize,
+		initialWindow: h2DefaultWindow,
+		sendWindow:    h2DefaultWindow,
+	}
+}
+
+func (h2 *h2Conn) newStream(id uint32) *h2Stream {
+	return &h2Stream{id: id, conn: h2, sendWindow: h2.initialWindow}
+}
+
+// upgradesToH2C reports whether the request asks to upgrade to h2c.
+func upgradesToH2C(p *httpParser) bool {
+	return p.version == HTTP1_1 && !p.chunked &&
+		hasToken(p.FindHeader([]byte("Upgrade")), []byte("h2c")) &&
+		hasToken(p.FindHeader([]byte("Connection")), []byte("HTTP2-Settings")) &&
+		p.FindHeader([]byte("HTTP2-Settings")) != nil
+}
+
+// upgradeFrom takes over the HTTP/1.1 request which upgraded the connection
+// as stream 1. It returns false if the HTTP2-Settings are invalid.
+func (h2 *h2Conn) upgradeFrom(p *httpParser, body []byte) bool {
+	settings, err := base64.RawURLEncoding.DecodeString(string(bytes.TrimRight(p.FindHeader([]byte("HTTP2-Settings")), "=")))
+	if err != nil || len(settings)%6 != 0 {
+		return false
+	}
+	h2.applySettings(settings)
+	if h2.closing {
+		return false
+	}
+	stream := h2.newStream(1)
+	stream.parser = p.clone()
+	stream.parser.version = HTTP2_0
+	stream.body = CopyBytes(body)
+	stream.remoteDone = true
+	h2.streams[1] = stream
+	h2.lastStream = 1
+	h2.upgrade = stream
+	return true
+}
+
+// start sends the server preface and answers the upgrade request.
+func (h2 *h2Conn) start() {
+	settings := []byte{}
+	settings = appendSetting(settings, settingMaxConcurrentStreams, h2MaxConcurrentStreams)
+	if max := h2.hs.server.options.MaxHeaderSize; max > 0 {
+		settings = appendSetting(settings, settingMaxHeaderListSize, uint32(max))
+	}
+	h2.writeFrame(frameSettings, 0, 0, settings)
+	if h2.upgrade != nil {
+		stream := h2.upgrade
+		h2.upgrade = nil
+		h2.dispatch(stream)
+	}
+}
+
+func appendSetting(dst []byte, id uint16, value uint32) []byte {
+	dst = binary.BigEndian.AppendUint16(dst, id)
+	return binary.BigEndian.AppendUint32(dst, value)
+}
+
+// onTraffic handles the frames received by the connection.
+func (h2 *h2Conn) onTraffic(c gnet.Conn) gnet.Action {
+	data, _ := c.Peek(-1)
+	consumed := 0
+	if !h2.preface {
+		if len(data) < len(http2Preface) {
+			if http2Preface[:len(data)] != string(data) {
+				return gnet.Close
+			}
+			h2.flush()
+			return gnet.None
+		}
+		if string(data[:len(http2Preface)]) != http2Preface {
+			h2.flush()
+			return gnet.Close
+		}
+		h2.preface = true
+		consumed = len(http2Preface)
+	}
+	for !h2.closing {
+		rest := data[consumed:]
+		if len(rest) < h2FrameHeaderLength {
+			break
+		}
+		length := int(rest[0])<<16 | int(rest[1])<<8 | int(rest[2])
+		if length > h2DefaultFrameSize {
+			h2.fail(h2FrameSizeError)
+			break
+		}
+		if len(rest) < h2FrameHeaderLength+length {
+			break
+		}
+		id := binary.BigEndian.Uint32(rest[5:]) & math.MaxInt32
+		payload := rest[h2FrameHeaderLength : h2FrameHeaderLength+length]
+		consumed += h2FrameHeaderLength + length
+		h2.handleFrame(rest[3], rest[4], id, payload)
+	}
+	if h2.closing {
+		consumed = c.InboundBuffered()
+	}
+	if consumed > 0 {
+		c.Discard(consumed)
+	}
+	h2.flush()
+	if h2.closing || h2.goAway && len(h2.streams) == 0 {
+		// the outbound buffer is flushed before closing.
+		return gnet.Close
+	}
+	return gnet.None
+}
+
+func (h2 *h2Conn) handleFrame(kind, flags byte, id uint32, payload []byte) {
+	if h2.headers != nil && (kind != frameContinuation || id != h2.headers.id) {
+		h2.fail(h2ProtocolError)
+		return
+	}
+	switch kind {
+	case frameData:
+		h2.onData(flags, id, payload)
+	case frameHeaders:
+		h2.onHeaders(flags, id, payload)
+	case frameContinuation:
+		if h2.headers == nil {
+			h2.fail(h2ProtocolError)
+			return
+		}
+		h2.appendBlock(flags, payload)
+	case framePriority:
+		if id == 0 {
+			h2.fail(h2ProtocolError)
+		} else if len(payload) != 5 {
+			h2.fail(h2FrameSizeError)
+		}
+	case frameRSTStream:
+		if id == 0 || id > h2.lastStream {
+			h2.fail(h2ProtocolError)
+			return
+		}
+		if len(payload) != 4 {
+			h2.fail(h2FrameSizeError)
+			return
+		}
+		if stream := h2.streams[id]; stream != nil {
+			stream.reset = true
+			delete(h2.streams, id)
+		}
+	case frameSettings:
+		if id != 0 {
+			h2.fail(h2ProtocolError)
+			return
+		}
+		if flags&flagAck != 0 {
+			if len(payload) != 0 {
+				h2.fail(h2FrameSizeError)
+			}
+			return
+		}
+		if len(payload)%6 != 0 {
+			h2.fail(h2FrameSizeError)
+			return
+		}
+		h2.applySettings(payload)
+		h2.writeFrame(frameSettings, flagAck, 0, nil)
+		h2.drainAll()
+	case framePushPromise:
+		h2.fail(h2ProtocolError)
+	case framePing:
+		if id != 0 {
+			h2.fail(h2ProtocolError)
+		} else if len(payload) != 8 {
+			h2.fail(h2FrameSizeError)
+		} else if flags&flagAck == 0 {
+			h2.writeFrame(framePing, flagAck, 0, payload)
+		}
+	case frameGoAway:
+		if id != 0 {
+			h2.fail(h2ProtocolError)
+			return
+		}
+		h2.goAway = true
+	case frameWindowUpdate:
+		h2.onWindowUpdate(id, payload)
+	}
+	// unknown frames are ignored.
+}
+
+func (h2 *h2Conn) applySettings(settings []byte) {
+	for i := 0; i+6 <= len(settings); i += 6 {
+		id := binary.BigEndian.Uint16(settings[i:])
+		value := binary.BigEndian.Uint32(settings[i+2:])
+		switch id {
+		case settingEnablePush:
+			if value > 1 {
+				h2.fail(h2ProtocolError)
+			}
+		case settingInitialWindowSize:
+			if value > h2MaxWindow {
+				h2.fail(h2FlowControlError)
+				return
+			}
+			delta := int64(value) - h2.initialWindow
+			for _, stream := range h2.streams {
+				stream.sendWindow += delta
+			}
+			h2.initialWindow = int64(value)
+		case settingMaxFrameSize:
+			if value < h2DefaultFrameSize || value > h2MaxFrameSizeLimit {
+				h2.fail(h2ProtocolError)
+				return
+			}
+			h2.maxFrameSize = int(value)
+		}
+	}
+}
+
+// unpad removes the padding of DATA and HEADERS frames.
+func (h2 *h2Conn) unpad(flags byte, payload []byte) ([]byte, bool) {
+	if flags&flagPadded == 0 {
+		return payload, true
+	}
+	if len(payload) == 0 || int(payload[0]) >= len(payload) {
+		h2.fail(h2ProtocolError)
+		return nil, false
+	}
+	return payload[1 : len(payload)-int(payload[0])], true
+}
+
+func (h2 *h2Conn) onHeaders(flags byte, id uint32, payload []byte) {
+	if id == 0 || id%2 == 0 {
+		h2.fail(h2ProtocolError)
+		return
+	}
+	payload, ok := h2.unpad(flags, payload)
+	if !ok {
+		return
+	}
+	if flags&flagPriority != 0 {
+		if len(payload) < 5 {
+			h2.fail(h2ProtocolError)
+			return
+		}
+		payload = payload[5:]
+	}
+	stream := h2.streams[id]
+	if stream == nil {
+		if id <= h2.lastStream {
+			h2.fail(h2StreamClosed)
+			return
+		}
+		h2.lastStream = id
+		stream = h2.newStream(id)
+		h2.streams[id] = stream
+	} else if stream.remoteDone || flags&flagEndStream == 0 {
+		// trailers must end the stream.
+		h2.fail(h2ProtocolError)
+		return
+	}
+	h2.headers = stream
+	h2.endStream = flags&flagEndStream != 0
+	h2.block = h2.block[:0]
+	h2.appendBlock(flags, payload)
+}
+
+// appendBlock collects a header block fragment
+// and handles the block once it is complete.
+func (h2 *h2Conn) appendBlock(flags byte, fragment []byte) {
+	h2.block = append(h2.block, fragment...)
+	if max := h2.hs.server.options.MaxHeaderSize; max > 0 && len(h2.block) > max {
+		h2.fail(h2EnhanceYourCalm)
+		return
+	}
+	if flags&flagEndHeaders == 0 {
+		return
+	}
+	stream := h2.headers
+	h2.headers = nil
+	if stream.parser != nil {
+		h2.readTrailers(stream)
+		return
+	}
+	h2.readHeaders(stream)
+}
+
+// readHeaders decodes the request header. It is converted to an HTTP/1.1
+// header which is parsed like any other request.
+func (h2 *h2Conn) readHeaders(stream *h2Stream) {
+	h2.pseudo = h2Pseudo{}
+	h2.fields = h2.fields[:0]
+	h2.cookies = h2.cookies[:0]
+	valid := true
+	err := h2.decodeBlock(func(name, value []byte) {
+		if valid {
+			valid = h2.addField(name, value)
+		}
+	})
+	if err != nil {
+		h2.failDecoding(err)
+		return
+	}
+	pseudo := h2.pseudo
+	if !valid || len(pseudo.method) == 0 || len(pseudo.path) == 0 || len(pseudo.scheme) == 0 {
+		h2.resetStream(stream, h2ProtocolError)
+		return
+	}
+	if len(h2.streams) > h2MaxConcurrentStreams {
+		h2.resetStream(stream, h2RefusedStream)
+		return
+	}
+	head := make([]byte, 0, len(pseudo.method)+len(pseudo.path)+len(pseudo.authority)+len(h2.fields)+len(h2.cookies)+32)
+	head = append(head, pseudo.method...)
+	head = append(head, ' ')
+	head = append(head, pseudo.path...)
+	head = append(head, " HTTP/1.1\r\n"...)
+	if len(pseudo.authority) > 0 {
+		head = append(head, "host: "...)
+		head = append(head, pseudo.authority...)
+		head = append(head, "\r\n"...)
+	}
+	head = append(head, h2.fields...)
+	if len(h2.cookies) > 0 {
+		head = append(head, "cookie: "...)
+		head = append(head, h2.cookies...)
+		head = append(head, "\r\n"...)
+	}
+	head = append(head, "\r\n"...)
+	stream.head = head
+	stream.parser = NewHTTPParser()
+	stream.parser.limits = h2.hs.server.parserLimits()
+	if _, err := stream.parser.Parse(head); err != nil {
+		h2.reject(stream, err)
+		return
+	}
+	stream.parser.version = HTTP2_0
+	if h2.endStream {
+		stream.remoteDone = true
+		h2.dispatch(stream)
+	}
+}
+
+// errHeaderListTooLarge is returned by decodeBlock if the decoded
+// header exceeds ServerOptions.MaxHeaderSize.
+var errHeaderListTooLarge = errors.New("http2 header list too large")
+
+// decodeBlock decodes the header block. The decoded size is limited
+// as well, indexed fields expand a small block to a huge header.
+func (h2 *h2Conn) decodeBlock(emit func(name, value []byte)) error {
+	max := h2.hs.server.options.MaxHeaderSize
+	size := 0
+	return h2.decoder.decode(h2.block, func(name, value []byte) error {
+		// the size of a field as defined for SETTINGS_MAX_HEADER_LIST_SIZE.
+		size += len(name) + len(value) + 32
+		if max > 0 && size > max {
+			return errHeaderListTooLarge
+		}
+		emit(name, value)
+		return nil
+	})
+}
+
+// failDecoding closes the connection after a header block couldn't be
+// decoded, the dynamic table is out of sync with the client afterwards.
+func (h2 *h2Conn) failDecoding(err error) {
+	if err == errHeaderListTooLarge {
+		h2.fail(h2EnhanceYourCalm)
+		return
+	}
+	h2.fail(h2CompressionError)
+}
+
+// addField adds a decoded field to the request header,
+// it returns false if the field is malformed.
+func (h2 *h2Conn) addField(name, value []byte) bool {
+	if bytes.ContainsAny(value, "\r\n\x00") || len(name) == 0 {
+		return false
+	}
+	if name[0] == ':' {
+		if h2.pseudo.regular {
+			return false
+		}
+		var field *[]byte
+		switch string(name) {
+		case ":method":
+			field = &h2.pseudo.method
+		case ":path":
+			field = &h2.pseudo.path
+		case ":authority":
+			field = &h2.pseudo.authority
+		case ":scheme":
+			field = &h2.pseudo.scheme
+		default:
+			return false
+		}
+		if *field != nil || bytes.ContainsAny(value, " \t") {
+			return false
+		}
+		*field = append([]byte{}, value...)
+		return true
+	}
+	h2.pseudo.regular = true
+	for _, b := range name {
+		if b >= 'A' && b <= 'Z' || b <= ' ' || b == ':' || b >= 0x7f {
+			return false
+		}
+	}
+	switch string(name) {
+	case "connection", "keep-alive", "proxy-connection", "transfer-encoding", "upgrade":
+		return false
+	case "te":
+		return string(value) == "trailers"
+	case "cookie":
+		// cookies may be split into multiple fields.
+		if len(h2.cookies) > 0 {
+			h2.cookies = append(h2.cookies, "; "...)
+		}
+		h2.cookies = append(h2.cookies, value...)
+		return true
+	}
+	h2.fields = append(h2.fields, name...)
+	h2.fields = append(h2.fields, ": "...)
+	h2.fields = append(h2.fields, value...)
+	h2.fields = append(h2.fields, "\r\n"...)
+	return true
+}
+
+func (h2 *h2Conn) readTrailers(stream *h2Stream) {
+	err := h2.decodeBlock(func(name, value []byte) {
+		if len(name) > 0 && name[0] != ':' {
+			stream.trailer = append(stream.trailer, pair{CopyBytes(name), CopyBytes(value)})
+		}
+	})
+	if err != nil {
+		h2.failDecoding(err)
+		return
+	}
+	stream.remoteDone = true
+	h2.dispatch(stream)
+}
+
+func (h2 *h2Conn) onData(flags byte, id uint32, payload []byte) {
+	if id == 0 || id > h2.lastStream {
+		h2.fail(h2ProtocolError)
+		return
+	}
+	// the whole frame counts against the flow control window,
+	// it is given back as soon as the data is read.
+	if len(payload) > 0 {
+		h2.writeWindowUpdate(0, len(payload))
+	}
+	length := len(payload)
+	payload, ok := h2.unpad(flags, payload)
+	if !ok {
+		return
+	}
+	stream := h2.streams[id]
+	if stream == nil || stream.dispatched {
+		// the stream was reset or answered early.
+		return
+	}
+	if stream.remoteDone || stream.parser == nil {
+		h2.resetStream(stream, h2StreamClosed)
+		return
+	}
+	stream.body = append(stream.body, payload...)
+	if max := h2.hs.server.options.MaxBodySize; max > 0 && len(stream.body) > max {
+		h2.reject(stream, ErrBodyTooLarge)
+		return
+	}
+	if flags&flagEndStream != 0 {
+		stream.remoteDone = true
+		h2.dispatch(stream)
+		return
+	}
+	if length > 0 {
+		h2.writeWindowUpdate(id, length)
+	}
+}
+
+func (h2 *h2Conn) onWindowUpdate(id uint32, payload []byte) {
+	if len(payload) != 4 {
+		h2.fail(h2FrameSizeError)
+		return
+	}
+	increment := int64(binary.BigEndian.Uint32(payload) & math.MaxInt32)
+	if id == 0 {
+		if increment == 0 {
+			h2.fail(h2ProtocolError)
+			return
+		}
+		h2.sendWindow += increment
+		if h2.sendWindow > h2MaxWindow {
+			h2.fail(h2FlowControlError)
+			return
+		}
+		h2.drainAll()
+		return
+	}
+	stream := h2.streams[id]
+	if stream == nil {
+		if id > h2.lastStream {
+			h2.fail(h2ProtocolError)
+		}
+		return
+	}
+	if increment == 0 {
+		h2.resetStream(stream, h2ProtocolError)
+		return
+	}
+	stream.sendWindow += increment
+	if stream.sendWindow > h2MaxWindow {
+		h2.resetStream(stream, h2FlowControlError)
+		return
+	}
+	h2.drain(stream)
+}
+
+// dispatch routes the complete request of the stream.
+func (h2 *h2Conn) dispatch(stream *h2Stream) {
+	stream.dispatched = true
+	p := stream.parser
+	if p.contentLength >= 0 && p.contentLength != int64(len(stream.body)) {
+		h2.resetStream(stream, h2ProtocolError)
+		return
+	}
+	p.trailer = stream.trailer
+	response := getResponse()
+	request := Request{
+		router:   h2.hs.router,
+		codec:    h2.codec,
+		conn:     h2.conn,
+		parser:   p,
+		h2:       stream,
+		response: response,
+	}
+	p.body = stream.body
+	if h2.hs.router.handle(request) {
+		// the blocking handler sends the response by respondAsync.
+		return
+	}
+	h2.respond(stream, response)
+	returnResponse(response)
+}
+
+// reject answers a malformed request on the stream.
+func (h2 *h2Conn) reject(stream *h2Stream, err error) {
+	stream.dispatched = true
+	status := rejectStatus(err)
+	if onReject := h2.hs.server.options.OnReject; onReject != nil {
+		onReject(h2.conn.RemoteAddr(), status, err)
+	}
+	response := getResponse()
+	response.status = status
+	response.WriteString(http.StatusText(status))
+	h2.respond(stream, response)
+	returnResponse(response)
+}
+
+// respond sends the complete response on the stream.
+func (h2 *h2Conn) respond(stream *h2Stream, r *Response) {
+	if stream.reset {
+		return
+	}
+	h2.writeHeaders(stream, h2HeaderBlock(r, r.body.Len()), false)
+	stream.pending = append(stream.pending, r.body.Bytes()...)
+	stream.trailers = append(stream.trailers, r.trailers...)
+	stream.pendingEnd = true
+	h2.drain(stream)
+}
+
+// respondAsync sends the response of a blocking handler.
+func (h2 *h2Conn) respondAsync(stream *h2Stream, r *Response) {
+	err := h2.codec.server.asyncWrite(h2.conn, h2.codec, nil, func(c gnet.Conn, err error) error {
+		h2.respond(stream, r)
+		returnResponse(r)
+		h2.update(c)
+		return nil
+	})
+	if err != nil {
+		returnResponse(r)
+	}
+}
+
+// h2HeaderBlock encodes the status and header of the response,
+// the content-length is omitted if it is negative.
+func h2HeaderBlock(r *Response, contentLength int) []byte {
+	block := appendHpackStatus(nil, r.status)
+	block = appendHpackField(block, "server", "ghttp over gnet")
+	for _, header := range r.headers {
+		switch http.CanonicalHeaderKey(header[0]) {
+		case "Connection", "Keep-Alive", "Proxy-Connection", "Transfer-Encoding", "Upgrade":
+			continue
+		case "Content-Length":
+			contentLength = -1
+		}
+		block = appendHpackField(block, header[0], header[1])
+	}
+	if contentLength >= 0 && len(r.trailers) == 0 {
+		block = appendHpackField(block, "content-length", strconv.Itoa(contentLength))
+	}
+	return block
+}
+
+// writeHeaders sends the header block, split into
+// CONTINUATION frames if it exceeds the frame size.
+func (h2 *h2Conn) writeHeaders(stream *h2Stream, block []byte, endStream bool) {
+	kind := byte(frameHeaders)
+	for {
+		n := len(block)
+		if n > h2.maxFrameSize {
+			n = h2.maxFrameSize
+		}
+		flags := byte(0)
+		if kind == frameHeaders && endStream {
+			flags |= flagEndStream
+		}
+		if n == len(block) {
+			flags |= flagEndHeaders
+		}
+		h2.writeFrame(kind, flags, stream.id, block[:n])
+		block = block[n:]
+		if len(block) == 0 {
+			return
+		}
+		kind = frameContinuation
+	}
+}
+
+// drain sends the pending data of the stream the flow
+// control windows allow and ends the stream once all is sent.
+func (h2 *h2Conn) drain(stream *h2Stream) {
+	if stream.reset || stream.sentEnd {
+		return
+	}
+	for len(stream.pending) > 0 {
+		n := int64(len(stream.pending))
+		n = min64(n, int64(h2.maxFrameSize))
+		n = min64(n, h2.sendWindow)
+		n = min64(n, stream.sendWindow)
+		if n <= 0 {
+			return
+		}
+		flags := byte(0)
+		if int(n) == len(stream.pending) && stream.pendingEnd && len(stream.trailers) == 0 {
+			flags = flagEndStream
+			stream.sentEnd = true
+		}
+		h2.writeFrame(frameData, flags, stream.id, stream.pending[:n])
+		stream.pending = stream.pending[n:]
+		h2.sendWindow -= n
+		stream.sendWindow -= n
+	}
+	stream.pending = nil
+	if !stream.pendingEnd {
+		return
+	}
+	if !stream.sentEnd {
+		stream.sentEnd = true
+		if len(stream.trailers) > 0 {
+			block := []byte{}
+			for _, trailer := range stream.trailers {
+				block = appendHpackField(block, trailer[0], trailer[1])
+			}
+			h2.writeHeaders(stream, block, true)
+		} else {
+			h2.writeFrame(frameData, flagEndStream, stream.id, nil)
+		}
+	}
+	if !stream.remoteDone {
+		// the request isn't needed anymore.
+		h2.writeRSTStream(stream.id, h2NoError)
+	}
+	delete(h2.streams, stream.id)
+}
+
+func (h2 *h2Conn) drainAll() {
+	for _, stream := range h2.streams {
+		h2.drain(stream)
+	}
+}
+
+func min64(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// resetStream aborts the stream with the error code.
+func (h2 *h2Conn) resetStream(stream *h2Stream, code uint32) {
+	stream.reset = true
+	stream.dispatched = true
+	h2.writeRSTStream(stream.id, code)
+	delete(h2.streams, stream.id)
+}
+
+// fail closes the connection because of an error.
+func (h2 *h2Conn) fail(code uint32) {
+	if h2.closing {
+		return
+	}
+	h2.closing = true
+	payload := binary.BigEndian.AppendUint32(nil, h2.lastStream)
+	payload = binary.BigEndian.AppendUint32(payload, code)
+	h2.writeFrame(frameGoAway, 0, 0, payload)
+}
+
+func (h2 *h2Conn) writeRSTStream(id uint32, code uint32) {
+	h2.writeFrame(frameRSTStream, 0, id, binary.BigEndian.AppendUint32(nil, code))
+}
+
+func (h2 *h2Conn) writeWindowUpdate(id uint32, increment int) {
+	h2.writeFrame(frameWindowUpdate, 0, id, binary.BigEndian.AppendUint32(nil, uint32(increment)))
+}
+
+func (h2 *h2Conn) writeFrame(kind, flags byte, id uint32, payload []byte) {
+	length := len(payload)
+	h2.out.Write([]byte{byte(length >> 16), byte(length >> 8), byte(length), kind, flags})
+	h2.out.Write(binary.BigEndian.AppendUint32(nil, id))
+	h2.out.Write(payload)
+}
+
+// update writes the frames of a response sent outside of OnTraffic
+// and restarts the idle timeout once all streams are done.
+func (h2 *h2Conn) update(c gnet.Conn) {
+	h2.flush()
+	if h2.hs.server.hasTimeouts() {
+		h2.codec.touch(c)
+	}
+}
+
+// flush writes the frames to the connection.
+func (h2 *h2Conn) flush() {
+	if h2.out.Len() > 0 {
+		h2.conn.Write(h2.out.Bytes())
+		h2.out.Reset()
+	}
+}
+
+// flushH2 sends the header and body written so far on the HTTP/2 stream.
+func (r *Response) flushH2() error {
+	stream := r.stream
+	var block []byte
+	if !stream.started {
+		stream.started = true
+		block = h2HeaderBlock(r, -1)
+	}
+	data := CopyBytes(r.body.Bytes())
+	r.body.Reset()
+	h2 := stream.h2
+	sent := false
+	return stream.write(&bytes.Buffer{}, func() int {
+		if h2.reset {
+			return 0
+		}
+		if !sent {
+			sent = true
+			if block != nil {
+				h2.conn.writeHeaders(h2, block, false)
+			}
+			h2.pending = append(h2.pending, data...)
+			h2.conn.drain(h2)
+			h2.conn.update(h2.conn.conn)
+		}
+		return len(h2.pending)
+	})
+}
+
+// finishH2 ends the streamed response on the HTTP/2 stream,
+// it is reset if the handler failed.
+func (r *Response) finishH2(err error) {
+	stream := r.stream
+	h2 := stream.h2
+	failed := err != nil || stream.err != nil
+	data := CopyBytes(r.body.Bytes())
+	trailers := append([][2]string{}, r.trailers...)
+	returnResponse(r)
+	stream.codec.server.asyncWrite(stream.conn, stream.codec, nil, func(c gnet.Conn, err error) error {
+		if h2.reset {
+			return nil
+		}
+		if failed {
+			h2.conn.resetStream(h2, h2InternalError)
+		} else {
+			h2.pending = append(h2.pending, data...)
+			h2.trailers = trailers
+			h2.pendingEnd = true
+			h2.conn.drain(h2)
+		}
+		h2.conn.update(c)
+		return nil
+	})
+}
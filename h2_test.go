@@ -0,0 +1,308 @@
+package ghttp
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// h2Client speaks just enough HTTP/2 to test the server.
+type h2Client struct {
+	t       *testing.T
+	conn    net.Conn
+	reader  *bufio.Reader
+	decoder *hpackDecoder
+}
+
+// h2Response is a response read by h2Client.
+type h2Response struct {
+	header map[string]string
+	body   string
+	reset  bool
+}
+
+func dialH2(t *testing.T, address string, settings ...uint32) *h2Client {
+	conn, err := net.Dial("tcp", address)
+	noError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	client := &h2Client{t: t, conn: conn, reader: bufio.NewReader(conn), decoder: newHpackDecoder(h2HeaderTableSize)}
+	_, err = conn.Write([]byte(http2Preface))
+	noError(t, err)
+	client.settings(settings...)
+	return client
+}
+
+// settings sends pairs of setting ids and values.
+func (c *h2Client) settings(settings ...uint32) {
+	payload := []byte{}
+	for i := 0; i+1 < len(settings); i += 2 {
+		payload = appendSetting(payload, uint16(settings[i]), settings[i+1])
+	}
+	c.writeFrame(frameSettings, 0, 0, payload)
+}
+
+func (c *h2Client) writeFrame(kind, flags byte, id uint32, payload []byte) {
+	length := len(payload)
+	frame := []byte{byte(length >> 16), byte(length >> 8), byte(length), kind, flags}
+	frame = binary.BigEndian.AppendUint32(frame, id)
+	_, err := c.conn.Write(append(frame, payload...))
+	noError(c.t, err)
+}
+
+// request sends the request on the stream, fields are pairs of names and values.
+func (c *h2Client) request(id uint32, body string, fields ...string) {
+	block := []byte{}
+	for i := 0; i+1 < len(fields); i += 2 {
+		block = appendHpackField(block, fields[i], fields[i+1])
+	}
+	flags := byte(flagEndHeaders)
+	if body == "" {
+		flags |= flagEndStream
+	}
+	c.writeFrame(frameHeaders, flags, id, block)
+	if body != "" {
+		c.writeFrame(frameData, flagEndStream, id, []byte(body))
+	}
+}
+
+func (c *h2Client) readFrame() (kind, flags byte, id uint32, payload []byte) {
+	header := make([]byte, h2FrameHeaderLength)
+	_, err := io.ReadFull(c.reader, header)
+	noError(c.t, err)
+	length := int(header[0])<<16 | int(header[1])<<8 | int(header[2])
+	payload = make([]byte, length)
+	_, err = io.ReadFull(c.reader, payload)
+	noError(c.t, err)
+	return header[3], header[4], binary.BigEndian.Uint32(header[5:]), payload
+}
+
+// responses reads frames until the streams ended.
+func (c *h2Client) responses(ids ...uint32) map[uint32]*h2Response {
+	responses := map[uint32]*h2Response{}
+	for _, id := range ids {
+		responses[id] = &h2Response{header: map[string]string{}}
+	}
+	open := len(ids)
+	for open > 0 {
+		kind, flags, id, payload := c.readFrame()
+		switch kind {
+		case frameSettings:
+			if flags&flagAck == 0 {
+				c.writeFrame(frameSettings, flagAck, 0, nil)
+			}
+			continue
+		case frameWindowUpdate, framePing:
+			continue
+		}
+		response := responses[id]
+		if response == nil {
+			c.t.Fatalf("unexpected frame %d on stream %d", kind, id)
+		}
+		switch kind {
+		case frameHeaders:
+			noError(c.t, c.decoder.decode(payload, func(name, value []byte) error {
+				response.header[string(name)] = string(value)
+				return nil
+			}))
+		case frameData:
+			response.body += string(payload)
+		case frameRSTStream:
+			response.reset = true
+			open--
+			continue
+		}
+		if flags&flagEndStream != 0 {
+			open--
+		}
+	}
+	return responses
+}
+
+func h2TestRouter() *Router {
+	router := NewRouter()
+	router.Register("@GET/hello/*", func(req Request, res *Response) error {
+		res.AddHeader([2]string{"X-Path", string(req.PathSequence(1))})
+		res.WriteString("hello " + req.Host())
+		return nil
+	})
+	router.Register("@POST/echo", func(req Request, res *Response) error {
+		res.Write(req.Body())
+		return nil
+	})
+	router.Register("@GET/blocking", func(req Request, res *Response) error {
+		req.HandleBlocking(func(req Request, res *Response) error {
+			time.Sleep(20 * time.Millisecond)
+			res.WriteString("blocking " + req.Header("X-Test"))
+			return nil
+		})
+		return nil
+	})
+	router.Register("@GET/stream", func(req Request, res *Response) error {
+		req.HandleBlocking(func(req Request, res *Response) error {
+			for _, part := range []string{"a", "b", "c"} {
+				res.WriteString(part)
+				if err := res.Flush(); err != nil {
+					return err
+				}
+			}
+			res.AddTrailer([2]string{"X-Done", "yes"})
+			return nil
+		})
+		return nil
+	})
+	router.Register("@GET/large", func(req Request, res *Response) error {
+		res.WriteString(strings.Repeat("x", 100))
+		return nil
+	})
+	return router
+}
+
+func TestHTTP2PriorKnowledge(t *testing.T) {
+	address := startServer(t, NewServer(h2TestRouter(), ServerOptions{HTTP2: true}))
+	client := dialH2(t, address)
+
+	client.request(1, "", ":method", "GET", ":scheme", "http", ":path", "/hello/world", ":authority", "example.com")
+	client.request(3, "ping", ":method", "POST", ":scheme", "http", ":path", "/echo")
+	client.request(5, "", ":method", "GET", ":scheme", "http", ":path", "/blocking", "x-test", "ok")
+	client.request(7, "", ":method", "GET", ":scheme", "http", ":path", "/missing")
+	responses := client.responses(1, 3, 5, 7)
+
+	assert(t, responses[1].header[":status"] == "200")
+	assert(t, responses[1].header["x-path"] == "world")
+	assert(t, responses[1].header["content-length"] == "17")
+	assert(t, responses[1].body == "hello example.com")
+	assert(t, responses[3].body == "ping")
+	assert(t, responses[5].body == "blocking ok")
+	assert(t, responses[7].header[":status"] == "404")
+}
+
+func TestHTTP2Upgrade(t *testing.T) {
+	address := startServer(t, NewServer(h2TestRouter(), ServerOptions{HTTP2: true}))
+	conn, err := net.Dial("tcp", address)
+	noError(t, err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err = conn.Write([]byte("GET /hello/up HTTP/1.1\r\nHost: a\r\nConnection: Upgrade, HTTP2-Settings\r\nUpgrade: h2c\r\nHTTP2-Settings: AAMAAABkAAQAAP__\r\n\r\n"))
+	noError(t, err)
+	client := &h2Client{t: t, conn: conn, reader: bufio.NewReader(conn), decoder: newHpackDecoder(h2HeaderTableSize)}
+	status, err := client.reader.ReadString('\n')
+	noError(t, err)
+	assert(t, status == "HTTP/1.1 101 Switching Protocols\r\n")
+	for {
+		line, err := client.reader.ReadString('\n')
+		noError(t, err)
+		if line == "\r\n" {
+			break
+		}
+	}
+	_, err = conn.Write([]byte(http2Preface))
+	noError(t, err)
+	client.settings()
+	response := client.responses(1)[1]
+	assert(t, response.header[":status"] == "200")
+	assert(t, response.body == "hello a")
+
+	client.request(3, "", ":method", "GET", ":scheme", "http", ":path", "/hello/again")
+	assert(t, client.responses(3)[3].header["x-path"] == "again")
+}
+
+func TestHTTP2Disabled(t *testing.T) {
+	address := startTestServer(t, h2TestRouter())
+	conn, err := net.Dial("tcp", address)
+	noError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("GET /hello/x HTTP/1.1\r\nHost: a\r\nConnection: Upgrade, HTTP2-Settings\r\nUpgrade: h2c\r\nHTTP2-Settings: \r\n\r\n"))
+	noError(t, err)
+	res, body := readResponse(t, bufio.NewReader(conn))
+	assert(t, res.StatusCode == 200)
+	assert(t, body == "hello a")
+}
+
+func TestHTTP2FlowControl(t *testing.T) {
+	address := startServer(t, NewServer(h2TestRouter(), ServerOptions{HTTP2: true}))
+	client := dialH2(t, address, settingInitialWindowSize, 10)
+	client.request(1, "", ":method", "GET", ":scheme", "http", ":path", "/large")
+
+	received := 0
+	for received < 10 {
+		kind, _, _, payload := client.readFrame()
+		if kind == frameData {
+			received += len(payload)
+		}
+	}
+	assert(t, received == 10)
+	client.writeFrame(frameWindowUpdate, 0, 1, binary.BigEndian.AppendUint32(nil, 90))
+	response := client.responses(1)[1]
+	assert(t, len(response.body) == 90)
+}
+
+func TestHTTP2StreamingResponse(t *testing.T) {
+	address := startServer(t, NewServer(h2TestRouter(), ServerOptions{HTTP2: true}))
+	client := dialH2(t, address)
+	client.request(1, "", ":method", "GET", ":scheme", "http", ":path", "/stream")
+	response := client.responses(1)[1]
+	assert(t, response.header[":status"] == "200")
+	assert(t, response.body == "abc")
+	assert(t, response.header["x-done"] == "yes")
+}
+
+func TestHTTP2Errors(t *testing.T) {
+	address := startServer(t, NewServer(h2TestRouter(), ServerOptions{HTTP2: true, MaxBodySize: 4}))
+	client := dialH2(t, address)
+
+	// connection-specific headers and missing pseudo headers are malformed.
+	client.request(1, "", ":method", "GET", ":scheme", "http", ":path", "/hello/x", "te", "gzip")
+	client.request(3, "", ":method", "GET", ":scheme", "http", ":path", "/hello/x", "connection", "close")
+	client.request(5, "", ":method", "GET", ":path", "/hello/x")
+	client.request(7, "too large", ":method", "POST", ":scheme", "http", ":path", "/echo")
+	responses := client.responses(1, 3, 5, 7)
+	assert(t, responses[1].reset)
+	assert(t, responses[3].reset)
+	assert(t, responses[5].reset)
+	assert(t, responses[7].header[":status"] == "413")
+
+	// a PUSH_PROMISE from the client is a connection error.
+	client.writeFrame(framePushPromise, flagEndHeaders, 9, []byte{0, 0, 0, 2})
+	for {
+		kind, _, _, payload := client.readFrame()
+		if kind == frameGoAway {
+			assert(t, binary.BigEndian.Uint32(payload[4:]) == h2ProtocolError)
+			break
+		}
+	}
+}
+
+func TestHTTP2DecodedHeaderLimit(t *testing.T) {
+	address := startServer(t, NewServer(h2TestRouter(), ServerOptions{HTTP2: true, MaxHeaderSize: 64 << 10}))
+	client := dialH2(t, address)
+
+	// a field added to the dynamic table and referenced over and over,
+	// the block is small but decodes to megabytes.
+	block := appendHpackField(nil, ":method", "GET")
+	block = appendHpackField(block, ":scheme", "http")
+	block = appendHpackField(block, ":path", "/hello/x")
+	block = appendHpackInt(block, 0x40, 6, 0)
+	block = appendHpackInt(block, 0, 7, 6)
+	block = append(block, "x-bomb"...)
+	block = appendHpackInt(block, 0, 7, 4000)
+	block = append(block, strings.Repeat("x", 4000)...)
+	for i := 0; i < 16000; i++ {
+		block = appendHpackInt(block, 0x80, 7, 62)
+	}
+	assert(t, len(block) < 64<<10)
+	client.writeFrame(frameHeaders, flagEndStream, 1, block[:10000])
+	client.writeFrame(frameContinuation, flagEndHeaders, 1, block[10000:])
+	for {
+		kind, _, _, payload := client.readFrame()
+		assert(t, kind != frameHeaders)
+		if kind == frameGoAway {
+			assert(t, binary.BigEndian.Uint32(payload[4:]) == h2EnhanceYourCalm)
+			break
+		}
+	}
+}
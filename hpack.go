@@ -0,0 +1,382 @@
+package ghttp
+
+import (
+	"errors"
+	"strconv"
+)
+
+// ErrCompression is returned for invalid HPACK header blocks.
+var ErrCompression = errors.New("invalid hpack header block")
+
+// hpackStaticTable is the static table of RFC 7541 Appendix A.
+var hpackStaticTable = [...][2]string{
+	{":authority", ""},
+	{":method", "GET"},
+	{":method", "POST"},
+	{":path", "/"},
+	{":path", "/index.html"},
+	{":scheme", "http"},
+	{":scheme", "https"},
+	{":status", "200"},
+	{":status", "204"},
+	{":status", "206"},
+	{":status", "304"},
+	{":status", "400"},
+	{":status", "404"},
+	{":status", "500"},
+	{"accept-charset", ""},
+	{"accept-encoding", "gzip, deflate"},
+	{"accept-language", ""},
+	{"accept-ranges", ""},
+	{"accept", ""},
+	{"access-control-allow-origin", ""},
+	{"age", ""},
+	{"allow", ""},
+	{"authorization", ""},
+	{"cache-control", ""},
+	{"content-disposition", ""},
+	{"content-encoding", ""},
+	{"content-language", ""},
+	{"content-length", ""},
+	{"content-location", ""},
+	{"content-range", ""},
+	{"content-type", ""},
+	{"cookie", ""},
+	{"date", ""},
+	{"etag", ""},
+	{"expect", ""},
+	{"expires", ""},
+	{"from", ""},
+	{"host", ""},
+	{"if-match", ""},
+	{"if-modified-since", ""},
+	{"if-none-match", ""},
+	{"if-range", ""},
+	{"if-unmodified-since", ""},
+	{"last-modified", ""},
+	{"link", ""},
+	{"location", ""},
+	{"max-forwards", ""},
+	{"proxy-authenticate", ""},
+	{"proxy-authorization", ""},
+	{"range", ""},
+	{"referer", ""},
+	{"refresh", ""},
+	{"retry-after", ""},
+	{"server", ""},
+	{"set-cookie", ""},
+	{"strict-transport-security", ""},
+	{"transfer-encoding", ""},
+	{"user-agent", ""},
+	{"vary", ""},
+	{"via", ""},
+	{"www-authenticate", ""},
+}
+
+var hpackStaticFields = func() []pair {
+	fields := make([]pair, len(hpackStaticTable))
+	for i, field := range hpackStaticTable {
+		fields[i] = pair{[]byte(field[0]), []byte(field[1])}
+	}
+	return fields
+}()
+
+// hpackEntryOverhead is added to the size of every
+// entry in the dynamic table.
+const hpackEntryOverhead = 32
+
+// hpackDecoder decodes the header blocks of a connection.
+type hpackDecoder struct {
+	// dynamic is the dynamic table, the newest entry is last.
+	dynamic []pair
+	size    int
+	maxSize int
+	// limit is the maximum table size announced to the peer.
+	limit int
+	// name and value hold Huffman decoded strings.
+	name  []byte
+	value []byte
+}
+
+func newHpackDecoder(limit int) *hpackDecoder {
+	return &hpackDecoder{maxSize: limit, limit: limit}
+}
+
+// decode decodes the header block and calls emit for every field.
+// The name and value are only valid until emit returns.
+func (d *hpackDecoder) decode(block []byte, emit func(name, value []byte) error) error {
+	fields := 0
+	for len(block) > 0 {
+		b := block[0]
+		switch {
+		case b&0x80 != 0:
+			// indexed header field.
+			index, n, err := hpackInt(block, 7)
+			if err != nil {
+				return err
+			}
+			block = block[n:]
+			field, ok := d.entry(index)
+			if !ok {
+				return ErrCompression
+			}
+			if err := emit(field[0], field[1]); err != nil {
+				return err
+			}
+		case b&0xe0 == 0x20:
+			// dynamic table size update, only allowed
+			// at the start of a header block.
+			size, n, err := hpackInt(block, 5)
+			if err != nil {
+				return err
+			}
+			if fields > 0 || size > uint64(d.limit) {
+				return ErrCompression
+			}
+			block = block[n:]
+			d.maxSize = int(size)
+			d.evict(0)
+			continue
+		default:
+			// literal header field, with incremental indexing if 01.
+			indexed := b&0xc0 == 0x40
+			prefix := uint8(4)
+			if indexed {
+				prefix = 6
+			}
+			index, n, err := hpackInt(block, prefix)
+			if err != nil {
+				return err
+			}
+			block = block[n:]
+			var name []byte
+			if index == 0 {
+				d.name, n, err = hpackString(d.name[:0], block)
+				if err != nil {
+					return err
+				}
+				block = block[n:]
+				name = d.name
+			} else {
+				field, ok := d.entry(index)
+				if !ok {
+					return ErrCompression
+				}
+				name = field[0]
+			}
+			d.value, n, err = hpackString(d.value[:0], block)
+			if err != nil {
+				return err
+			}
+			block = block[n:]
+			if indexed {
+				d.add(name, d.value)
+			}
+			if err := emit(name, d.value); err != nil {
+				return err
+			}
+		}
+		fields++
+	}
+	return nil
+}
+
+// entry returns the field at the index of the static
+// and dynamic table.
+func (d *hpackDecoder) entry(index uint64) (pair, bool) {
+	if index == 0 {
+		return pair{}, false
+	}
+	if index <= uint64(len(hpackStaticFields)) {
+		return hpackStaticFields[index-1], true
+	}
+	index -= uint64(len(hpackStaticTable)) + 1
+	if index >= uint64(len(d.dynamic)) {
+		return pair{}, false
+	}
+	return d.dynamic[len(d.dynamic)-1-int(index)], true
+}
+
+// add inserts a copy of the field into the dynamic table.
+func (d *hpackDecoder) add(name, value []byte) {
+	size := len(name) + len(value) + hpackEntryOverhead
+	d.evict(size)
+	if size > d.maxSize {
+		// an entry larger than the table empties it.
+		return
+	}
+	field := make([]byte, len(name)+len(value))
+	copy(field, name)
+	copy(field[len(name):], value)
+	d.dynamic = append(d.dynamic, pair{field[:len(name)], field[len(name):]})
+	d.size += size
+}
+
+// evict removes the oldest entries until size bytes fit into the table.
+func (d *hpackDecoder) evict(size int) {
+	drop := 0
+	for d.size+size > d.maxSize && drop < len(d.dynamic) {
+		field := d.dynamic[drop]
+		d.size -= len(field[0]) + len(field[1]) + hpackEntryOverhead
+		drop++
+	}
+	if drop > 0 {
+		n := copy(d.dynamic, d.dynamic[drop:])
+		d.dynamic = d.dynamic[:n]
+	}
+}
+
+// hpackInt decodes an integer with an n bit prefix.
+func hpackInt(data []byte, n uint8) (uint64, int, error) {
+	if len(data) == 0 {
+		return 0, 0, ErrCompression
+	}
+	max := uint64(1)<<n - 1
+	value := uint64(data[0]) & max
+	if value < max {
+		return value, 1, nil
+	}
+	shift := uint(0)
+	for i := 1; i < len(data); i++ {
+		b := data[i]
+		value += uint64(b&0x7f) << shift
+		if b&0x80 == 0 {
+			return value, i + 1, nil
+		}
+		shift += 7
+		if shift > 28 {
+			// values don't exceed 32 bit.
+			break
+		}
+	}
+	return 0, 0, ErrCompression
+}
+
+// hpackString decodes a string literal and appends it to dst.
+func hpackString(dst, data []byte) ([]byte, int, error) {
+	length, n, err := hpackInt(data, 7)
+	if err != nil {
+		return dst, 0, err
+	}
+	end := n + int(length)
+	if length > uint64(len(data)) || end > len(data) {
+		return dst, 0, ErrCompression
+	}
+	if data[0]&0x80 == 0 {
+		return append(dst, data[n:end]...), end, nil
+	}
+	dst, err = huffmanDecode(dst, data[n:end])
+	return dst, end, err
+}
+
+// huffmanNode is a node of the Huffman decoding tree, leafs have a symbol.
+type huffmanNode struct {
+	children [2]uint16
+	symbol   int16
+}
+
+var huffmanTree = buildHuffmanTree()
+
+func buildHuffmanTree() []huffmanNode {
+	tree := []huffmanNode{{symbol: -1}}
+	for symbol, code := range huffmanCodes {
+		node := 0
+		for i := int(huffmanCodeLengths[symbol]) - 1; i >= 0; i-- {
+			bit := code >> uint(i) & 1
+			next := tree[node].children[bit]
+			if next == 0 {
+				next = uint16(len(tree))
+				tree = append(tree, huffmanNode{symbol: -1})
+				tree[node].children[bit] = next
+			}
+			node = int(next)
+		}
+		tree[node].symbol = int16(symbol)
+	}
+	return tree
+}
+
+// huffmanDecode decodes the Huffman coded src and appends it to dst.
+func huffmanDecode(dst, src []byte) ([]byte, error) {
+	node := 0
+	// depth and ones track the padding after the last symbol,
+	// it must be shorter than 8 bits of the EOS code.
+	depth := 0
+	ones := true
+	for _, b := range src {
+		for i := 7; i >= 0; i-- {
+			bit := b >> uint(i) & 1
+			next := huffmanTree[node].children[bit]
+			if next == 0 {
+				return dst, ErrCompression
+			}
+			node = int(next)
+			depth++
+			ones = ones && bit == 1
+			if symbol := huffmanTree[node].symbol; symbol >= 0 {
+				dst = append(dst, byte(symbol))
+				node, depth, ones = 0, 0, true
+			}
+		}
+	}
+	if depth > 7 || !ones {
+		return dst, ErrCompression
+	}
+	return dst, nil
+}
+
+// appendHpackInt encodes the integer with an n bit prefix,
+// flags are the bits of the first byte above the prefix.
+func appendHpackInt(dst []byte, flags byte, n uint8, value uint64) []byte {
+	max := uint64(1)<<n - 1
+	if value < max {
+		return append(dst, flags|byte(value))
+	}
+	dst = append(dst, flags|byte(max))
+	value -= max
+	for value >= 0x80 {
+		dst = append(dst, byte(value)|0x80)
+		value >>= 7
+	}
+	return append(dst, byte(value))
+}
+
+// appendHpackField encodes the field as a literal without indexing,
+// the strings aren't Huffman coded. The name is lowercased.
+func appendHpackField(dst []byte, name, value string) []byte {
+	dst = append(dst, 0)
+	dst = appendHpackInt(dst, 0, 7, uint64(len(name)))
+	for i := 0; i < len(name); i++ {
+		b := name[i]
+		if b >= 'A' && b <= 'Z' {
+			b += 'a' - 'A'
+		}
+		dst = append(dst, b)
+	}
+	dst = appendHpackInt(dst, 0, 7, uint64(len(value)))
+	return append(dst, value...)
+}
+
+// appendHpackStatus encodes the :status pseudo header.
+func appendHpackStatus(dst []byte, status int) []byte {
+	switch status {
+	case 200:
+		return append(dst, 0x80|8)
+	case 204:
+		return append(dst, 0x80|9)
+	case 206:
+		return append(dst, 0x80|10)
+	case 304:
+		return append(dst, 0x80|11)
+	case 400:
+		return append(dst, 0x80|12)
+	case 404:
+		return append(dst, 0x80|13)
+	case 500:
+		return append(dst, 0x80|14)
+	}
+	// literal without indexing with the name of :status.
+	dst = append(dst, 8)
+	dst = append(dst, 3)
+	return strconv.AppendInt(dst, int64(status), 10)
+}
@@ -0,0 +1,65 @@
+package ghttp
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+func decodeBlock(t *testing.T, d *hpackDecoder, block string) string {
+	raw, err := hex.DecodeString(strings.ReplaceAll(block, " ", ""))
+	noError(t, err)
+	fields := []string{}
+	err = d.decode(raw, func(name, value []byte) error {
+		fields = append(fields, string(name)+": "+string(value))
+		return nil
+	})
+	noError(t, err)
+	return strings.Join(fields, "\n")
+}
+
+func TestHpackDecode(t *testing.T) {
+	// the requests with Huffman coding of RFC 7541 C.4.
+	d := newHpackDecoder(h2HeaderTableSize)
+	assert(t, decodeBlock(t, d, "8286 8441 8cf1 e3c2 e5f2 3a6b a0ab 90f4 ff") ==
+		":method: GET\n:scheme: http\n:path: /\n:authority: www.example.com")
+	assert(t, decodeBlock(t, d, "8286 84be 5886 a8eb 1064 9cbf") ==
+		":method: GET\n:scheme: http\n:path: /\n:authority: www.example.com\ncache-control: no-cache")
+	assert(t, decodeBlock(t, d, "8287 85bf 4088 25a8 49e9 5ba9 7d7f 8925 a849 e95b b8e8 b4bf") ==
+		":method: GET\n:scheme: https\n:path: /index.html\n:authority: www.example.com\ncustom-key: custom-value")
+	assert(t, d.size == 164)
+}
+
+func TestHpackDecodeInvalid(t *testing.T) {
+	for _, block := range []string{
+		"80",         // index 0
+		"ff",         // truncated integer
+		"be",         // empty dynamic table
+		"0085",       // truncated string
+		"8220",       // size update after a field
+		"3fe21f",     // size update above the limit
+		"4081ff8161", // Huffman string of EOS
+	} {
+		raw, _ := hex.DecodeString(block)
+		err := newHpackDecoder(h2HeaderTableSize).decode(raw, func(name, value []byte) error { return nil })
+		assert(t, err == ErrCompression)
+	}
+}
+
+func TestHpackEncode(t *testing.T) {
+	block := appendHpackStatus(nil, 200)
+	block = appendHpackStatus(block, 418)
+	block = appendHpackField(block, "Content-Type", "text/plain")
+	block = appendHpackField(block, "x-long", strings.Repeat("a", 300))
+	d := newHpackDecoder(h2HeaderTableSize)
+	fields := []string{}
+	noError(t, d.decode(block, func(name, value []byte) error {
+		fields = append(fields, string(name)+": "+string(value))
+		return nil
+	}))
+	assert(t, len(fields) == 4)
+	assert(t, fields[0] == ":status: 200")
+	assert(t, fields[1] == ":status: 418")
+	assert(t, fields[2] == "content-type: text/plain")
+	assert(t, fields[3] == "x-long: "+strings.Repeat("a", 300))
+}
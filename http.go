@@ -1,16 +1,23 @@
 package ghttp
 
 import (
-	"bufio"
 	"bytes"
+	"io"
+	"net"
+	"net/http"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/panjf2000/gnet/v2"
 )
 
 type httpServer struct {
+	server *Server
 	router *Router
+	// conns maps the open connections to their codec
+	// if the server has timeouts.
+	conns sync.Map
 }
 
 var bytePool = sync.Pool{
@@ -18,18 +25,204 @@ var bytePool = sync.Pool{
 }
 
 type httpCodec struct {
-	parser          *httpParser
-	buf             *bytes.Buffer
+	server *Server
+	parser *httpParser
+	buf    *bytes.Buffer
+	// mu guards closed and the number of pending
+	// writes of blocking handlers.
+	mu      sync.Mutex
+	closed  bool
+	pending int
+	// notify is closed when the connection closes.
+	notify chan struct{}
+	// blocked is set while a request handed off with HandleBlocking
+	// is in flight. Pipelined requests behind it stay buffered in the
+	// connection until its response has been written.
+	blocked bool
+	// closing is set if the connection is closed after
+	// the current response, further requests aren't read.
+	closing bool
+	// phase is what the connection is waiting for, its timeout
+	// expires at deadline in nanoseconds. deadline is zero if the
+	// phase has no timeout, it is read by OnTick.
+	phase    phase
+	deadline atomic.Int64
+	// head holds the request header while its body spans
+	// multiple reads.
+	head []byte
+	// reading is set while the body of the current request
+	// is received. It is collected in body or handed to stream.
+	reading bool
+	// remaining is the number of body bytes still to be read
+	// if the body is not chunked.
+	remaining int
+	chunks    chunkedDecoder
+	body      *bytes.Buffer
+	stream    *bodyStream
+	// streamed is the size of the body handed to stream so far.
+	streamed int
+	// upgrade is set by Request.Upgrade, the connection switches
+	// to ws once the response is written.
+	upgrade *WebSocket
+	ws      *WebSocket
+	// h2 is set once the connection speaks HTTP/2.
+	h2 *h2Conn
+	// tls is the TLS layer of the connection if enabled.
+	tls *tlsConn
+	// proxied is set once the PROXY protocol header is read,
+	// clientAddr is the client it names.
+	proxied    bool
+	clientAddr net.Addr
+}
+
+// readBody consumes body data of the current request from data.
+// It returns the number of bytes consumed and whether the body is complete.
+func (hc *httpCodec) readBody(data []byte) (int, bool, error) {
+	if !hc.parser.chunked {
+		n := hc.remaining
+		if n > len(data) {
+			n = len(data)
+		}
+		hc.remaining -= n
+		if err := hc.writeBody(data[:n]); err != nil {
+			return n, false, err
+		}
+		return n, hc.remaining == 0, nil
+	}
+	consumed := 0
+	for !hc.chunks.done() {
+		n, part, err := hc.chunks.decode(data[consumed:])
+		if err != nil {
+			return consumed, false, err
+		}
+		if n == 0 {
+			return consumed, false, nil
+		}
+		consumed += n
+		if err := hc.writeBody(part); err != nil {
+			return consumed, false, err
+		}
+		if err := hc.limitBody(); err != nil {
+			return consumed, false, err
+		}
+	}
+	return consumed, true, nil
+}
+
+// limitBody checks the size of a chunked body.
+func (hc *httpCodec) limitBody() error {
+	if hc.stream != nil {
+		if max := hc.server.options.MaxStreamBodySize; max > 0 && hc.streamed > max {
+			return ErrBodyTooLarge
+		}
+		return nil
+	}
+	if max := hc.server.options.MaxBodySize; max > 0 && hc.body.Len() > max {
+		return ErrBodyTooLarge
+	}
+	return nil
+}
+
+func (hc *httpCodec) writeBody(p []byte) error {
+	if len(p) == 0 {
+		return nil
+	}
+	if hc.stream != nil {
+		hc.streamed += len(p)
+		return hc.stream.write(p)
+	}
+	hc.body.Write(p)
+	return nil
+}
+
+// writeDone marks a pending write as done.
+func (hc *httpCodec) writeDone() {
+	hc.mu.Lock()
+	if hc.pending > 0 {
+		hc.pending--
+		hc.server.writes.Add(-1)
+	}
+	hc.mu.Unlock()
+}
+
+// close marks the codec as closed, pending writes
+// won't be done anymore.
+func (hc *httpCodec) close() {
+	hc.mu.Lock()
+	hc.closed = true
+	hc.server.writes.Add(int64(-hc.pending))
+	hc.pending = 0
+	if hc.notify != nil {
+		close(hc.notify)
+		hc.notify = nil
+	}
+	hc.mu.Unlock()
+}
+
+// closeNotify returns a channel which is closed
+// when the connection closes.
+func (hc *httpCodec) closeNotify() <-chan struct{} {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	if hc.notify == nil {
+		hc.notify = make(chan struct{})
+		if hc.closed {
+			close(hc.notify)
+		}
+	}
+	return hc.notify
+}
+
+func (hc *httpCodec) reset() {
+	hc.buf.Reset()
+	hc.blocked = false
+	hc.closing = false
+	hc.phase = phaseNone
+	hc.deadline.Store(0)
+	hc.reading = false
+	hc.remaining = 0
+	hc.chunks.reset()
+	if hc.body != nil {
+		hc.body.Reset()
+		bytePool.Put(hc.body)
+		hc.body = nil
+	}
+	if hc.stream != nil {
+		hc.stream.finish(io.ErrUnexpectedEOF, nil)
+		hc.stream = nil
+	}
+	hc.upgrade = nil
+	hc.ws = nil
+	hc.h2 = nil
+	hc.tls = nil
 }
 
 func (hs *httpServer) OnBoot(eng gnet.Engine) (action gnet.Action) {
+	if hs.server.boot(eng) {
+		return gnet.Shutdown
+	}
 	return gnet.None
 }
 
 func (hs *httpServer) OnClose(c gnet.Conn, err error) (action gnet.Action) {
-	hc := c.Context().(*httpCodec)
-	hc.buf.Reset()
-	codecPool.Put(hc)
+	hc, ok := c.Context().(*httpCodec)
+	if !ok {
+		return gnet.None
+	}
+	hs.conns.Delete(c)
+	if hc.ws != nil {
+		hc.ws.onClose()
+	}
+	if hc.tls != nil {
+		hc.tls.close()
+	}
+	hc.close()
+	// a blocking handler or a WebSocket may still use the codec.
+	blocked := hc.blocked || hc.ws != nil || hc.h2 != nil
+	hc.reset()
+	if !blocked {
+		codecPool.Put(hc)
+	}
 	return gnet.None
 }
 
@@ -37,7 +230,16 @@ func (hs *httpServer) OnShutdown(eng gnet.Engine) {
 }
 
 func (hs *httpServer) OnTick() (delay time.Duration, action gnet.Action) {
-	delay = time.Second
+	delay = hs.server.tickInterval()
+	now := time.Now().UnixNano()
+	hs.conns.Range(func(key, value any) bool {
+		deadline := value.(*httpCodec).deadline.Load()
+		if deadline != 0 && now > deadline {
+			// the timeout is handled by OnTraffic on the event loop.
+			key.(gnet.Conn).Wake(nil)
+		}
+		return true
+	})
 	return
 }
 
@@ -47,55 +249,350 @@ var codecPool = sync.Pool{
 	},
 }
 
-func (hs httpServer) OnOpen(c gnet.Conn) ([]byte, gnet.Action) {
-	c.SetContext(codecPool.Get().(*httpCodec))
+func (hs *httpServer) OnOpen(c gnet.Conn) ([]byte, gnet.Action) {
+	if hs.server.closing.Load() {
+		return nil, gnet.Close
+	}
+	if hs.server.tls != nil && !hs.server.startHandshake() {
+		// too many handshakes are running.
+		return nil, gnet.Close
+	}
+	hc := codecPool.Get().(*httpCodec)
+	hc.server = hs.server
+	hc.closed = false
+	hc.proxied = false
+	hc.clientAddr = nil
+	hc.parser.limits = hs.server.parserLimits()
+	c.SetContext(hc)
+	if hs.server.tls != nil {
+		hc.tls = newTLSConn(c, hs.server.tls)
+		go hc.tls.handshake(hs.server.handshakeTimeout(), hs.server.endHandshake)
+	}
+	if hs.server.hasTimeouts() {
+		hc.touch(c)
+		hs.conns.Store(c, hc)
+	}
 	return nil, gnet.None
 }
 
 func (hs *httpServer) OnTraffic(c gnet.Conn) (action gnet.Action) {
 	hc := c.Context().(*httpCodec)
-	body := bytePool.Get().(*bytes.Buffer)
-pipeline:
-	data, err := c.Next(-1)
-	if err != nil && err != bufio.ErrBufferFull {
-		return gnet.Close
+	if hs.server.options.ProxyProtocol && !hc.proxied {
+		data, _ := c.Peek(-1)
+		n, addr, err := parseProxyHeader(data)
+		if err == ErrIncompleteData {
+			return hs.wait(c, hc)
+		}
+		if err != nil {
+			return gnet.Close
+		}
+		c.Discard(n)
+		hc.proxied = true
+		hc.clientAddr = addr
 	}
-	headerOffset, err := hc.parser.Parse(data)
-	if err == ErrIncompleteData {
-		return gnet.None
+	if hc.tls != nil {
+		if action := hc.tls.onTraffic(); action != gnet.None {
+			return action
+		}
+		if !hc.tls.ready {
+			return hs.wait(hc.tls, hc)
+		}
+		// the codec reads and writes the plaintext.
+		c = hc.tls
+	}
+	if hc.ws != nil {
+		return hc.ws.onTraffic(c)
 	}
-	if err != nil {
+	if hc.h2 != nil {
+		return hs.h2Traffic(c, hc)
+	}
+	data, _ := c.Peek(-1)
+	consumed := 0
+	hc.buf.Reset()
+	if hs.server.hasTimeouts() {
+		hc.touch(c)
+		if hc.expired() {
+			return hs.timeout(c, hc)
+		}
+	}
+	// handle every complete request in the buffer in order,
+	// responses are collected in hc.buf and written at once.
+	for {
+		if hc.reading {
+			n, done, err := hc.readBody(data)
+			data = data[n:]
+			consumed += n
+			if err != nil && hc.stream != nil {
+				// the blocking handler owns the response.
+				hc.stream.finish(err, nil)
+				hc.stream = nil
+				action = gnet.Close
+				break
+			}
+			if err != nil {
+				hs.reject(c, hc, err)
+				break
+			}
+			if !done {
+				break
+			}
+			hc.reading = false
+			hc.parser.trailer = hc.chunks.trailers
+			if hc.stream != nil {
+				hc.stream.finish(nil, hc.parser.trailer)
+				hc.stream = nil
+			} else {
+				hs.dispatch(c, hc, hc.body.Bytes(), nil)
+				hc.body.Reset()
+				bytePool.Put(hc.body)
+				hc.body = nil
+			}
+		}
+		if hc.blocked || hc.closing || hc.upgrade != nil || len(data) == 0 {
+			break
+		}
+		if hs.server.options.HTTP2 && data[0] == http2Preface[0] {
+			n := len(data)
+			if n > len(http2Preface) {
+				n = len(http2Preface)
+			}
+			if string(data[:n]) == http2Preface[:n] {
+				// HTTP/2 with prior knowledge, wait for the whole preface.
+				if n == len(http2Preface) {
+					hc.h2 = newH2Conn(hs, c, hc)
+				}
+				break
+			}
+		}
+
+		headerOffset, err := hc.parser.Parse(data)
+		if err == ErrIncompleteData {
+			break
+		}
+		if err != nil {
+			hs.reject(c, hc, err)
+			break
+		}
+
+		bodyLen := int(hc.parser.contentLength)
+		if bodyLen == -1 {
+			bodyLen = 0
+		}
+		streams := hs.router.streams(hc.parser)
+		max := hs.server.options.MaxBodySize
+		if streams {
+			max = hs.server.options.MaxStreamBodySize
+		}
+		if max > 0 && bodyLen > max {
+			hs.reject(c, hc, ErrBodyTooLarge)
+			break
+		}
+		if !hc.parser.chunked && bodyLen <= len(data)-headerOffset {
+			body := data[headerOffset : headerOffset+bodyLen]
+			data = data[headerOffset+bodyLen:]
+			consumed += headerOffset + bodyLen
+			if hs.server.options.HTTP2 && hc.tls == nil && upgradesToH2C(hc.parser) {
+				h2 := newH2Conn(hs, c, hc)
+				if h2.upgradeFrom(hc.parser, body) {
+					hc.buf.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: h2c\r\n\r\n")
+					hc.h2 = h2
+					break
+				}
+			}
+			hs.dispatch(c, hc, body, nil)
+			continue
+		}
+
+		// the body spans multiple reads or is chunked, keep
+		// the header and collect the body as it arrives.
+		data = data[headerOffset:]
+		consumed += headerOffset
+		hc.head = hc.parser.retain(hc.head)
+		hc.reading = true
+		hc.remaining = bodyLen
+		hc.chunks.reset()
+		if streams {
+			hc.streamed = 0
+			hc.stream = newBodyStream()
+			hs.dispatch(c, hc, nil, hc.stream)
+		} else {
+			hc.body = bytePool.Get().(*bytes.Buffer)
+		}
+	}
+	if consumed > 0 {
+		c.Discard(consumed)
+	}
+	if hc.buf.Len() > 0 {
+		c.Write(hc.buf.Bytes())
+	}
+	if hc.h2 != nil {
+		hc.h2.start()
+		return hs.h2Traffic(c, hc)
+	}
+	if hc.closing && !hc.blocked {
+		// the outbound buffer is flushed before closing.
 		return gnet.Close
 	}
+	if hs.server.hasTimeouts() {
+		hc.touch(c)
+	}
+	if hc.upgrade != nil {
+		hc.ws, hc.upgrade = hc.upgrade, nil
+		hc.ws.open()
+		if c.InboundBuffered() > 0 {
+			return hc.ws.onTraffic(c)
+		}
+	}
+	return
+}
 
-	bodyLen := int(hc.parser.contentLength)
-	if body.Len() < bodyLen {
-		body.Write(data[headerOffset:])
+// wait waits for more data before requests are read,
+// the connection is closed if its timeout expired.
+func (hs *httpServer) wait(c gnet.Conn, hc *httpCodec) gnet.Action {
+	if hs.server.hasTimeouts() {
+		hc.touch(c)
+		if hc.expired() {
+			return gnet.Close
+		}
 	}
-	if bodyLen == -1 {
-		bodyLen = 0
+	return gnet.None
+}
+
+// h2Traffic handles the frames of an HTTP/2 connection. Only
+// the idle timeout applies, it restarts with every read.
+func (hs *httpServer) h2Traffic(c gnet.Conn, hc *httpCodec) gnet.Action {
+	if hs.server.hasTimeouts() && c.InboundBuffered() == 0 && hc.expired() {
+		return gnet.Close
 	}
-	data = data[headerOffset+bodyLen:]
-	if len(data) > 0 {
-		goto pipeline
+	action := hc.h2.onTraffic(c)
+	if hs.server.hasTimeouts() {
+		hc.phase = phaseNone
+		hc.touch(c)
 	}
+	return action
+}
 
-	hc.buf.Reset()
-	detached := hs.router.call(c, hc.parser, body.Bytes())
-	body.Reset()
-	bytePool.Put(body)
-	// handle the request
-	if !detached {
+// timeout handles the expired phase of the connection and closes it.
+// An incomplete request is answered with 408 Request Timeout.
+func (hs *httpServer) timeout(c gnet.Conn, hc *httpCodec) gnet.Action {
+	switch hc.phase {
+	case phaseHeader:
+		hs.reject(c, hc, ErrTimeout)
+	case phaseBody:
+		if hc.stream != nil {
+			// the blocking handler owns the response.
+			hc.stream.finish(ErrTimeout, nil)
+			hc.stream = nil
+		} else {
+			hs.reject(c, hc, ErrTimeout)
+		}
+	}
+	if hc.buf.Len() > 0 {
 		c.Write(hc.buf.Bytes())
 	}
-	return
+	return gnet.Close
+}
+
+// reject answers the current request with the status for err
+// and closes the connection after the response.
+func (hs *httpServer) reject(c gnet.Conn, hc *httpCodec, err error) {
+	status := rejectStatus(err)
+	if onReject := hs.server.options.OnReject; onReject != nil {
+		onReject(c.RemoteAddr(), status, err)
+	}
+	response := getResponse()
+	response.status = status
+	response.close = true
+	response.WriteString(http.StatusText(status))
+	response.renderResponse(hc.buf)
+	returnResponse(response)
+	hc.closing = true
+}
+
+// dispatch routes the current request.
+func (hs *httpServer) dispatch(c gnet.Conn, hc *httpCodec, body []byte, stream *bodyStream) {
+	detached, close := hs.router.call(c, hc.parser, body, stream)
+	hc.blocked = hc.blocked || detached
+	hc.closing = hc.closing || close
+	// the timeouts of the next request start over.
+	hc.phase = phaseNone
+}
+
+// phase is what a connection is waiting for.
+type phase int
+
+const (
+	// phaseNone waits for a blocking handler, it has no timeout.
+	phaseNone phase = iota
+	phaseIdle
+	phaseHeader
+	phaseBody
+	phaseWrite
+)
+
+// touch updates the phase of the connection. The deadline
+// is set when a new phase starts.
+func (hc *httpCodec) touch(c gnet.Conn) {
+	current := phaseIdle
+	switch {
+	case hc.ws != nil || hc.upgrade != nil:
+		current = phaseNone
+	case hc.h2 != nil:
+		if len(hc.h2.streams) > 0 {
+			current = phaseNone
+		}
+	case hc.reading:
+		current = phaseBody
+	case hc.blocked:
+		current = phaseNone
+	case c.OutboundBuffered() > 0:
+		current = phaseWrite
+	case c.InboundBuffered() > 0:
+		current = phaseHeader
+	}
+	if current == hc.phase {
+		return
+	}
+	hc.phase = current
+	if timeout := hc.server.timeout(current); timeout > 0 {
+		hc.deadline.Store(time.Now().Add(timeout).UnixNano())
+	} else {
+		hc.deadline.Store(0)
+	}
+}
+
+// expired reports whether the timeout of the current phase expired.
+func (hc *httpCodec) expired() bool {
+	deadline := hc.deadline.Load()
+	return deadline != 0 && time.Now().UnixNano() > deadline
+}
+
+// resume continues handling pipelined requests after a blocking
+// request has been answered. It must be called on the event loop.
+func resume(c gnet.Conn) {
+	hc, ok := c.Context().(*httpCodec)
+	if !ok {
+		return
+	}
+	hc.blocked = false
+	if hc.closing {
+		c.Close()
+		return
+	}
+	if hc.server.hasTimeouts() {
+		hc.touch(c)
+	}
+	if c.InboundBuffered() > 0 {
+		c.Wake(nil)
+	}
 }
 
-// StartServer launches and listens as an http server on the given address.
+// StartServer launches and listens as an http server on the given addresses.
 // This will block until an error occurs or the server is terminated.
-func StartServer(router *Router, address string) error {
-	http := &httpServer{router}
-	return gnet.Run(http, address, gnet.WithMulticore(true))
+//
+// Use NewServer to configure the server or shut it down.
+func StartServer(router *Router, addresses ...string) error {
+	return NewServer(router, ServerOptions{Multicore: true}).ListenAndServe(addresses...)
 }
 
 var byteSlicePoolSizes = []int{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12}
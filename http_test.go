@@ -0,0 +1,975 @@
+package ghttp
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func freeAddress(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	noError(t, err)
+	defer l.Close()
+	return l.Addr().String()
+}
+
+func startTestServer(t *testing.T, router *Router) string {
+	return startServer(t, NewServer(router, ServerOptions{Multicore: true}))
+}
+
+func startServer(t *testing.T, server *Server) string {
+	address := freeAddress(t)
+	go server.ListenAndServe("tcp://" + address)
+	t.Cleanup(func() {
+		server.Shutdown(context.Background())
+	})
+	for i := 0; i < 100; i++ {
+		conn, err := net.Dial("tcp", address)
+		if err == nil {
+			conn.Close()
+			return address
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("server did not start on %s", address)
+	return ""
+}
+
+func readResponse(t *testing.T, reader *bufio.Reader) (*http.Response, string) {
+	res, err := http.ReadResponse(reader, nil)
+	noError(t, err)
+	body, err := io.ReadAll(res.Body)
+	noError(t, err)
+	return res, string(body)
+}
+
+func TestPipelining(t *testing.T) {
+	router := NewRouter()
+	router.Register("@GET/#", func(req Request, res *Response) error {
+		res.Write(req.PathSequence(0))
+		return nil
+	})
+	router.Register("@GET/slow/#", func(req Request, res *Response) error {
+		req.HandleBlocking(func(req Request, res *Response) error {
+			time.Sleep(50 * time.Millisecond)
+			res.Write(req.PathSequence(1))
+			return nil
+		})
+		return nil
+	})
+	router.Register("@POST/#", func(req Request, res *Response) error {
+		res.Write(req.Body())
+		return nil
+	})
+	address := startTestServer(t, router)
+	conn, err := net.Dial("tcp", address)
+	noError(t, err)
+	defer conn.Close()
+
+	_, err = conn.Write([]byte("GET /1 HTTP/1.1\r\n\r\n" +
+		"POST /2 HTTP/1.1\r\nContent-Length: 3\r\n\r\ntwo" +
+		"GET /slow/3 HTTP/1.1\r\n\r\n" +
+		"GET /4 HTTP/1.1\r\n\r\n" +
+		"POST /5 HTTP/1.1\r\nContent-Length: 4\r\n\r\nfive"))
+	noError(t, err)
+
+	reader := bufio.NewReader(conn)
+	for _, expected := range []string{"1", "two", "3", "4", "five"} {
+		res, body := readResponse(t, reader)
+		assert(t, res.StatusCode == 200)
+		if body != expected {
+			t.Fatalf("Expected body %s got %s", expected, body)
+		}
+	}
+}
+
+func TestPipeliningSplitReads(t *testing.T) {
+	router := NewRouter()
+	router.Register("@POST/", func(req Request, res *Response) error {
+		res.WriteString(strconv.Itoa(len(req.Body())))
+		return nil
+	})
+	address := startTestServer(t, router)
+	conn, err := net.Dial("tcp", address)
+	noError(t, err)
+	defer conn.Close()
+
+	_, err = conn.Write([]byte("POST / HTTP/1.1\r\nContent-Length: 5\r\n\r\nhelloPOST / HT"))
+	noError(t, err)
+	time.Sleep(20 * time.Millisecond)
+	_, err = conn.Write([]byte("TP/1.1\r\nContent-Length: 2\r\n\r\nhi"))
+	noError(t, err)
+
+	reader := bufio.NewReader(conn)
+	for _, expected := range []string{"5", "2"} {
+		_, body := readResponse(t, reader)
+		if body != expected {
+			t.Fatalf("Expected body %s got %s", expected, body)
+		}
+	}
+}
+
+func TestBodySpanningReads(t *testing.T) {
+	router := NewRouter()
+	router.Register("@POST/", func(req Request, res *Response) error {
+		res.Write(req.Body())
+		return nil
+	})
+	address := startTestServer(t, router)
+	conn, err := net.Dial("tcp", address)
+	noError(t, err)
+	defer conn.Close()
+
+	body := strings.Repeat("ghttp", 100000)
+	_, err = conn.Write([]byte("POST / HTTP/1.1\r\nContent-Length: " + strconv.Itoa(len(body)) + "\r\n\r\n"))
+	noError(t, err)
+	for i := 0; i < len(body); i += 10000 {
+		_, err = conn.Write([]byte(body[i : i+10000]))
+		noError(t, err)
+	}
+
+	_, res := readResponse(t, bufio.NewReader(conn))
+	assert(t, res == body)
+}
+
+func TestStreamBody(t *testing.T) {
+	router := NewRouter()
+	router.RegisterStream("@POST/", func(req Request, res *Response) error {
+		n, err := io.Copy(io.Discard, req.BodyReader())
+		if err != nil {
+			return err
+		}
+		res.WriteString(strconv.Itoa(int(n)))
+		return nil
+	})
+	router.Register("@GET/", func(req Request, res *Response) error {
+		res.WriteString("after")
+		return nil
+	})
+	address := startTestServer(t, router)
+	conn, err := net.Dial("tcp", address)
+	noError(t, err)
+	defer conn.Close()
+
+	_, err = conn.Write([]byte("POST / HTTP/1.1\r\nContent-Length: 100000\r\n\r\n"))
+	noError(t, err)
+	for i := 0; i < 10; i++ {
+		time.Sleep(time.Millisecond)
+		_, err = conn.Write([]byte(strings.Repeat("a", 10000)))
+		noError(t, err)
+	}
+	_, err = conn.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+	noError(t, err)
+
+	reader := bufio.NewReader(conn)
+	for _, expected := range []string{"100000", "after"} {
+		_, body := readResponse(t, reader)
+		if body != expected {
+			t.Fatalf("Expected body %s got %s", expected, body)
+		}
+	}
+}
+
+func TestChunked(t *testing.T) {
+	router := NewRouter()
+	router.Register("@POST/", func(req Request, res *Response) error {
+		res.Write(req.Body())
+		res.AddTrailer([2]string{"Checksum", req.Trailer("Checksum")})
+		return nil
+	})
+	router.RegisterStream("@PUT/", func(req Request, res *Response) error {
+		body, err := io.ReadAll(req.BodyReader())
+		if err != nil {
+			return err
+		}
+		res.Chunked().Write(body)
+		res.AddHeader([2]string{"Checksum", req.Trailer("Checksum")})
+		return nil
+	})
+	address := startTestServer(t, router)
+	conn, err := net.Dial("tcp", address)
+	noError(t, err)
+	defer conn.Close()
+
+	for _, method := range []string{"POST", "PUT"} {
+		_, err = conn.Write([]byte(method + " / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n"))
+		noError(t, err)
+		time.Sleep(10 * time.Millisecond)
+		_, err = conn.Write([]byte("7\r\n, world\r\n0\r\nChecksum: abc\r\n\r\n"))
+		noError(t, err)
+	}
+
+	reader := bufio.NewReader(conn)
+	res, body := readResponse(t, reader)
+	assert(t, body == "hello, world")
+	assert(t, res.TransferEncoding[0] == "chunked")
+	assert(t, res.Trailer.Get("Checksum") == "abc")
+
+	res, body = readResponse(t, reader)
+	assert(t, body == "hello, world")
+	assert(t, res.TransferEncoding[0] == "chunked")
+	assert(t, res.Header.Get("Checksum") == "abc")
+}
+
+func TestMiddlewareBlocking(t *testing.T) {
+	router := NewRouter()
+	router.Use(func(next HandlerFunc) HandlerFunc {
+		return func(req Request, res *Response) error {
+			res.AddHeader([2]string{"Middleware", "yes"})
+			return next(req, res)
+		}
+	})
+	router.Register("@GET/", func(req Request, res *Response) error {
+		req.HandleBlocking(func(req Request, res *Response) error {
+			res.WriteString("blocking")
+			return nil
+		})
+		return nil
+	})
+	address := startTestServer(t, router)
+	conn, err := net.Dial("tcp", address)
+	noError(t, err)
+	defer conn.Close()
+
+	_, err = conn.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+	noError(t, err)
+	res, body := readResponse(t, bufio.NewReader(conn))
+	assert(t, body == "blocking")
+	assert(t, len(res.Header.Values("Middleware")) == 1)
+}
+
+func TestMiddlewareAfterBlocking(t *testing.T) {
+	router := NewRouter()
+	var runs atomic.Int32
+	router.Use(func(next HandlerFunc) HandlerFunc {
+		return func(req Request, res *Response) error {
+			runs.Add(1)
+			res.AddHeader([2]string{"Before", "yes"})
+			err := next(req, res)
+			for i := 0; i < 100; i++ {
+				res.AddHeader([2]string{"After", "yes"})
+			}
+			res.WriteString("after")
+			return err
+		}
+	})
+	router.Register("@GET/", func(req Request, res *Response) error {
+		req.HandleBlocking(func(req Request, res *Response) error {
+			for i := 0; i < 100; i++ {
+				res.AddHeader([2]string{"Blocking", "yes"})
+			}
+			res.WriteString("blocking")
+			return nil
+		})
+		return nil
+	})
+	address := startTestServer(t, router)
+	conn, err := net.Dial("tcp", address)
+	noError(t, err)
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+	for i := 0; i < 20; i++ {
+		_, err = conn.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+		noError(t, err)
+		res, body := readResponse(t, reader)
+		assert(t, body == "blockingafter")
+		assert(t, res.Header.Get("Before") == "yes")
+		assert(t, res.Header.Get("After") == "yes")
+		assert(t, res.Header.Get("Blocking") == "yes")
+	}
+	assert(t, runs.Load() == 20)
+}
+
+func TestMiddlewareSeesBlockingError(t *testing.T) {
+	router := NewRouter()
+	blockingErr := errors.New("conflict")
+	var seen atomic.Value
+	router.Use(func(next HandlerFunc) HandlerFunc {
+		return func(req Request, res *Response) error {
+			err := next(req, res)
+			if err != nil {
+				seen.Store(err)
+				res.Status(http.StatusConflict)
+				res.AddHeader([2]string{"Failed", "yes"})
+			}
+			return nil
+		}
+	})
+	router.Register("@POST/", func(req Request, res *Response) error {
+		req.HandleBlocking(func(req Request, res *Response) error {
+			if string(req.Body()) != "hello" {
+				return nil
+			}
+			return blockingErr
+		})
+		return nil
+	})
+	address := startTestServer(t, router)
+	conn, err := net.Dial("tcp", address)
+	noError(t, err)
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+	for i := 0; i < 5; i++ {
+		_, err = conn.Write([]byte("POST / HTTP/1.1\r\nContent-Length: 5\r\n\r\nhello"))
+		noError(t, err)
+		res, _ := readResponse(t, reader)
+		assert(t, res.StatusCode == http.StatusConflict)
+		assert(t, res.Header.Get("Failed") == "yes")
+		assert(t, seen.Load() == blockingErr)
+	}
+}
+
+func TestNotFoundAndMethodNotAllowed(t *testing.T) {
+	router := NewRouter()
+	handler := func(req Request, res *Response) error { return nil }
+	router.Register("@POST/items/#", handler)
+	router.Register("@DELETE/items/#", handler)
+	router.Group("/custom").NotFound(func(req Request, res *Response) error {
+		res.WriteString("nothing at " + req.Path())
+		return nil
+	})
+	address := startTestServer(t, router)
+	conn, err := net.Dial("tcp", address)
+	noError(t, err)
+	defer conn.Close()
+
+	_, err = conn.Write([]byte("GET /items/1 HTTP/1.1\r\n\r\nGET /missing HTTP/1.1\r\n\r\n"))
+	noError(t, err)
+	reader := bufio.NewReader(conn)
+	res, body := readResponse(t, reader)
+	assert(t, res.StatusCode == 405)
+	assert(t, res.Header.Get("Allow") == "POST, DELETE")
+	assert(t, body == "Method Not Allowed")
+
+	res, body = readResponse(t, reader)
+	assert(t, res.StatusCode == 404)
+	assert(t, body == "nothing at /missing")
+}
+
+func TestErrorHandler(t *testing.T) {
+	router := NewRouter()
+	router.Register("@GET/typed", func(req Request, res *Response) error {
+		res.WriteString("discarded")
+		return Error(400, "bad id").AddHeader([2]string{"X-Reason", "id"})
+	})
+	router.Register("@GET/blocking", func(req Request, res *Response) error {
+		req.HandleBlocking(func(req Request, res *Response) error {
+			return errors.New("failed")
+		})
+		return nil
+	})
+	address := startTestServer(t, router)
+	conn, err := net.Dial("tcp", address)
+	noError(t, err)
+	defer conn.Close()
+
+	_, err = conn.Write([]byte("GET /typed HTTP/1.1\r\n\r\nGET /blocking HTTP/1.1\r\n\r\n"))
+	noError(t, err)
+	reader := bufio.NewReader(conn)
+	res, body := readResponse(t, reader)
+	assert(t, res.StatusCode == 400)
+	assert(t, res.Header.Get("X-Reason") == "id")
+	assert(t, body == "bad id")
+
+	res, body = readResponse(t, reader)
+	assert(t, res.StatusCode == 500)
+	assert(t, body == "Internal Server Error")
+
+}
+
+func TestCustomErrorHandler(t *testing.T) {
+	router := NewRouter()
+	router.Register("@GET/typed", func(req Request, res *Response) error {
+		res.AddHeader([2]string{"Content-Type", "text/plain"})
+		res.SetCookie(Cookie{Name: "session", Value: "1"})
+		return Error(400, "bad id")
+	})
+	router.ErrorHandler(func(req Request, res *Response, err error) {
+		var httpErr *HTTPError
+		if errors.As(err, &httpErr) {
+			res.Status(httpErr.Status)
+		}
+		res.AddHeader([2]string{"Content-Type", "application/json"})
+		res.WriteString(`{"error":"` + err.Error() + `"}`)
+	})
+	address := startTestServer(t, router)
+	conn, err := net.Dial("tcp", address)
+	noError(t, err)
+	defer conn.Close()
+
+	_, err = conn.Write([]byte("GET /typed HTTP/1.1\r\n\r\n"))
+	noError(t, err)
+	res, body := readResponse(t, bufio.NewReader(conn))
+	assert(t, res.StatusCode == 400)
+	assert(t, len(res.Header.Values("Content-Type")) == 1)
+	assert(t, res.Header.Get("Content-Type") == "application/json")
+	assert(t, res.Header.Get("Set-Cookie") == "")
+	assert(t, body == `{"error":"bad id"}`)
+}
+
+func TestPanicRecovery(t *testing.T) {
+	router := NewRouter()
+	router.Register("@GET/panic", func(req Request, res *Response) error {
+		panic("handler")
+	})
+	router.Register("@GET/blocking", func(req Request, res *Response) error {
+		req.HandleBlocking(func(req Request, res *Response) error {
+			panic("blocking")
+		})
+		return nil
+	})
+	router.Register("@GET/", func(req Request, res *Response) error {
+		res.WriteString("alive")
+		return nil
+	})
+	var panics []string
+	var mu sync.Mutex
+	router.ErrorHandler(func(req Request, res *Response, err error) {
+		var panicErr *PanicError
+		if errors.As(err, &panicErr) {
+			mu.Lock()
+			panics = append(panics, panicErr.Value.(string))
+			mu.Unlock()
+		}
+		DefaultErrorHandler(req, res, err)
+	})
+	address := startTestServer(t, router)
+	conn, err := net.Dial("tcp", address)
+	noError(t, err)
+	defer conn.Close()
+
+	_, err = conn.Write([]byte("GET /panic HTTP/1.1\r\n\r\nGET /blocking HTTP/1.1\r\n\r\nGET / HTTP/1.1\r\n\r\n"))
+	noError(t, err)
+	reader := bufio.NewReader(conn)
+	for _, expected := range []int{500, 500, 200} {
+		res, _ := readResponse(t, reader)
+		assert(t, res.StatusCode == expected)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	assert(t, len(panics) == 2 && panics[0] == "handler" && panics[1] == "blocking")
+}
+
+func TestShutdown(t *testing.T) {
+	router := NewRouter()
+	router.Register("@GET/", func(req Request, res *Response) error {
+		req.HandleBlocking(func(req Request, res *Response) error {
+			time.Sleep(100 * time.Millisecond)
+			res.WriteString("done")
+			return nil
+		})
+		return nil
+	})
+	server := NewServer(router, ServerOptions{NumEventLoop: 2})
+	address := freeAddress(t)
+	stopped := make(chan error)
+	go func() {
+		stopped <- server.ListenAndServe("tcp://" + address)
+	}()
+	var conn net.Conn
+	var err error
+	for i := 0; i < 100; i++ {
+		if conn, err = net.Dial("tcp", address); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	noError(t, err)
+	defer conn.Close()
+
+	_, err = conn.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+	noError(t, err)
+	time.Sleep(10 * time.Millisecond)
+	go func() {
+		noError(t, server.Shutdown(context.Background()))
+	}()
+	time.Sleep(10 * time.Millisecond)
+	if runtime.GOOS == "linux" {
+		// the listener doesn't accept new connections.
+		_, err = net.DialTimeout("tcp", address, 50*time.Millisecond)
+		assert(t, err != nil)
+	}
+
+	_, body := readResponse(t, bufio.NewReader(conn))
+	assert(t, body == "done")
+	select {
+	case err = <-stopped:
+		noError(t, err)
+	case <-time.After(time.Second):
+		t.Fatalf("server did not stop")
+	}
+}
+
+func TestMultipleListeners(t *testing.T) {
+	router := NewRouter()
+	router.Register("@GET/", func(req Request, res *Response) error {
+		res.WriteString(req.LocalAddr().Network() + " " + req.LocalAddr().String())
+		return nil
+	})
+	server := NewServer(router, ServerOptions{})
+	address := freeAddress(t)
+	// gnet lowercases addresses, t.TempDir contains the test name.
+	dir, err := os.MkdirTemp("", "ghttp")
+	noError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	socket := filepath.Join(dir, "ghttp.sock")
+	stopped := make(chan error)
+	go func() {
+		stopped <- server.ListenAndServe("tcp://"+address, "unix://"+socket)
+	}()
+	dial := func(network, address string) net.Conn {
+		for i := 0; i < 100; i++ {
+			if conn, err := net.Dial(network, address); err == nil {
+				t.Cleanup(func() { conn.Close() })
+				return conn
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatalf("server did not start on %s", address)
+		return nil
+	}
+
+	for _, listener := range [][2]string{{"tcp", address}, {"unix", socket}} {
+		conn := dial(listener[0], listener[1])
+		_, err := conn.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+		noError(t, err)
+		_, body := readResponse(t, bufio.NewReader(conn))
+		assert(t, body == listener[0]+" "+listener[1])
+	}
+
+	noError(t, server.Shutdown(context.Background()))
+	select {
+	case err := <-stopped:
+		noError(t, err)
+	case <-time.After(time.Second):
+		t.Fatalf("server did not stop")
+	}
+}
+
+func TestListenerFailure(t *testing.T) {
+	server := NewServer(NewRouter(), ServerOptions{})
+	assert(t, server.ListenAndServe() == ErrNoAddress)
+
+	// the second listener fails as the address is in use.
+	address := startTestServer(t, NewRouter())
+	stopped := make(chan error)
+	go func() {
+		stopped <- server.ListenAndServe("tcp://"+freeAddress(t), "tcp://"+address)
+	}()
+	select {
+	case err := <-stopped:
+		assert(t, err != nil)
+	case <-time.After(5 * time.Second):
+		t.Fatalf("server did not stop")
+	}
+}
+
+func TestConnectionClose(t *testing.T) {
+	router := NewRouter()
+	router.Register("@GET/#", func(req Request, res *Response) error {
+		res.Write(req.PathSequence(0))
+		return nil
+	})
+	router.Register("@GET/slow/#", func(req Request, res *Response) error {
+		req.HandleBlocking(func(req Request, res *Response) error {
+			res.Write(req.PathSequence(1))
+			return nil
+		})
+		return nil
+	})
+	address := startTestServer(t, router)
+
+	for _, raw := range []string{
+		"GET /1 HTTP/1.1\r\nConnection: close\r\n\r\nGET /2 HTTP/1.1\r\n\r\n",
+		"GET /1 HTTP/1.0\r\n\r\nGET /2 HTTP/1.0\r\n\r\n",
+		"GET /slow/1 HTTP/1.1\r\nConnection: close\r\n\r\nGET /2 HTTP/1.1\r\n\r\n",
+	} {
+		conn, err := net.Dial("tcp", address)
+		noError(t, err)
+		_, err = conn.Write([]byte(raw))
+		noError(t, err)
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		reader := bufio.NewReader(conn)
+		res, body := readResponse(t, reader)
+		assert(t, body == "1")
+		assert(t, res.Close)
+		_, err = reader.ReadByte()
+		assert(t, err == io.EOF)
+		conn.Close()
+	}
+
+	conn, err := net.Dial("tcp", address)
+	noError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("GET /1 HTTP/1.0\r\nConnection: keep-alive\r\n\r\nGET /2 HTTP/1.1\r\n\r\n"))
+	noError(t, err)
+	reader := bufio.NewReader(conn)
+	res, body := readResponse(t, reader)
+	assert(t, body == "1" && !res.Close)
+	res, body = readResponse(t, reader)
+	assert(t, body == "2" && !res.Close)
+}
+
+func TestIdleTimeout(t *testing.T) {
+	router := NewRouter()
+	router.Register("@GET/", func(req Request, res *Response) error {
+		return nil
+	})
+	address := startServer(t, NewServer(router, ServerOptions{IdleTimeout: 50 * time.Millisecond}))
+	conn, err := net.Dial("tcp", address)
+	noError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+	noError(t, err)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	reader := bufio.NewReader(conn)
+	readResponse(t, reader)
+	_, err = reader.ReadByte()
+	assert(t, err == io.EOF)
+}
+
+func TestRequestLimits(t *testing.T) {
+	router := NewRouter()
+	router.Register("@POST/", func(req Request, res *Response) error {
+		res.Write(req.Body())
+		return nil
+	})
+	address := startServer(t, NewServer(router, ServerOptions{
+		MaxURILength:   16,
+		MaxHeaderSize:  128,
+		MaxHeaderCount: 4,
+		MaxBodySize:    8,
+	}))
+
+	for raw, status := range map[string]int{
+		"POST /" + strings.Repeat("a", 32) + " HTTP/1.1\r\n\r\n":                            http.StatusRequestURITooLong,
+		"POST / HTTP/1.1\r\nA: " + strings.Repeat("a", 128) + "\r\n\r\n":                    http.StatusRequestHeaderFieldsTooLarge,
+		"POST / HTTP/1.1\r\nA: 1\r\nB: 2\r\nC: 3\r\nD: 4\r\nE: 5\r\n\r\n":                   http.StatusRequestHeaderFieldsTooLarge,
+		"POST / HTTP/1.1\r\nContent-Length: 9\r\n\r\n123456789":                             http.StatusRequestEntityTooLarge,
+		"POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n5\r\n12345\r\n5\r\n12345\r\n": http.StatusRequestEntityTooLarge,
+	} {
+		conn, err := net.Dial("tcp", address)
+		noError(t, err)
+		_, err = conn.Write([]byte(raw))
+		noError(t, err)
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		reader := bufio.NewReader(conn)
+		res, _ := readResponse(t, reader)
+		assert(t, res.StatusCode == status)
+		assert(t, res.Close)
+		_, err = reader.ReadByte()
+		assert(t, err == io.EOF)
+		conn.Close()
+	}
+
+	conn, err := net.Dial("tcp", address)
+	noError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("POST / HTTP/1.1\r\nContent-Length: 8\r\n\r\n12345678"))
+	noError(t, err)
+	res, body := readResponse(t, bufio.NewReader(conn))
+	assert(t, res.StatusCode == http.StatusOK && body == "12345678")
+}
+
+func TestStreamBodyLimit(t *testing.T) {
+	router := NewRouter()
+	errs := make(chan error, 1)
+	router.RegisterStream("@PUT/", func(req Request, res *Response) error {
+		_, err := io.Copy(io.Discard, req.BodyReader())
+		errs <- err
+		return err
+	})
+	address := startServer(t, NewServer(router, ServerOptions{MaxStreamBodySize: 16}))
+
+	conn, err := net.Dial("tcp", address)
+	noError(t, err)
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = conn.Write([]byte("PUT / HTTP/1.1\r\nContent-Length: 17\r\n\r\n"))
+	noError(t, err)
+	res, _ := readResponse(t, bufio.NewReader(conn))
+	assert(t, res.StatusCode == http.StatusRequestEntityTooLarge)
+
+	conn, err = net.Dial("tcp", address)
+	noError(t, err)
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = conn.Write([]byte("PUT / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\na\r\n0123456789\r\n"))
+	noError(t, err)
+	time.Sleep(10 * time.Millisecond)
+	_, err = conn.Write([]byte("a\r\n0123456789\r\n"))
+	noError(t, err)
+	select {
+	case err := <-errs:
+		assert(t, err == ErrBodyTooLarge)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the stream didn't fail")
+	}
+	_, err = bufio.NewReader(conn).ReadByte()
+	assert(t, err != nil)
+}
+
+func TestSlowStream(t *testing.T) {
+	router := NewRouter()
+	sent := make(chan struct{})
+	errs := make(chan error, 1)
+	router.RegisterStream("@PUT/", func(req Request, res *Response) error {
+		<-sent
+		_, err := io.Copy(io.Discard, req.BodyReader())
+		errs <- err
+		return err
+	})
+	address := startTestServer(t, router)
+
+	conn, err := net.Dial("tcp", address)
+	noError(t, err)
+	defer conn.Close()
+	size := 8 * streamBufferSize
+	_, err = conn.Write([]byte("PUT / HTTP/1.1\r\nContent-Length: " + strconv.Itoa(size) + "\r\n\r\n"))
+	noError(t, err)
+	time.Sleep(10 * time.Millisecond)
+	// the server closes the connection while the body is sent.
+	conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	_, err = conn.Write(make([]byte, size))
+	assert(t, err != nil)
+	close(sent)
+	select {
+	case err := <-errs:
+		assert(t, err == ErrSlowStream)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the stream didn't fail")
+	}
+}
+
+func TestRejectMalformed(t *testing.T) {
+	router := NewRouter()
+	router.Register("/", func(req Request, res *Response) error {
+		return nil
+	})
+	var mu sync.Mutex
+	rejected := []error{}
+	address := startServer(t, NewServer(router, ServerOptions{
+		OnReject: func(remoteAddr net.Addr, status int, err error) {
+			mu.Lock()
+			rejected = append(rejected, err)
+			mu.Unlock()
+		},
+	}))
+
+	requests := []struct {
+		raw    string
+		status int
+		err    error
+	}{
+		{"GET / HTTX/1.1\r\n\r\n", http.StatusBadRequest, ErrBadData},
+		{"BREW / HTTP/1.1\r\n\r\n", http.StatusNotImplemented, ErrUnsupportedMethod},
+		{"POST / HTTP/1.1\r\nTransfer-Encoding: gzip, chunked\r\n\r\n0\r\n\r\n", http.StatusNotImplemented, ErrUnsupportedEncoding},
+		{"POST / HTTP/1.1\r\nContent-Length: 3\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n", http.StatusBadRequest, ErrBadData},
+		{"GET / HTTP/2.0\r\n\r\n", http.StatusHTTPVersionNotSupported, ErrUnsupportedProtocol},
+		{"POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\nzz\r\n", http.StatusBadRequest, ErrBadChunk},
+		{"POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n-1\r\nabc", http.StatusBadRequest, ErrBadChunk},
+		{"GET / HTTP/1.1\r\nBadHeader\r\n\r\n", http.StatusBadRequest, ErrBadData},
+		{"POST / HTTP/1.1\r\nContent-Length: 18446744073709551614\r\n\r\n", http.StatusRequestEntityTooLarge, ErrBodyTooLarge},
+		{"POST / HTTP/1.1\r\nContent-Length: 9223372036854775799\r\n\r\n", http.StatusRequestEntityTooLarge, ErrBodyTooLarge},
+		{"POST / HTTP/1.1\r\nContent-Length: 1\r\nContent-Length: 2\r\n\r\nab", http.StatusBadRequest, ErrBadData},
+	}
+	for _, request := range requests {
+		conn, err := net.Dial("tcp", address)
+		noError(t, err)
+		_, err = conn.Write([]byte("GET / HTTP/1.1\r\n\r\n" + request.raw))
+		noError(t, err)
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		reader := bufio.NewReader(conn)
+		res, _ := readResponse(t, reader)
+		assert(t, res.StatusCode == http.StatusOK)
+		res, body := readResponse(t, reader)
+		assert(t, res.StatusCode == request.status)
+		assert(t, body == http.StatusText(request.status))
+		assert(t, res.Close)
+		_, err = reader.ReadByte()
+		assert(t, err == io.EOF)
+		conn.Close()
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert(t, len(rejected) == len(requests))
+	for i, request := range requests {
+		assert(t, rejected[i] == request.err)
+	}
+}
+
+func TestReadTimeouts(t *testing.T) {
+	router := NewRouter()
+	router.Register("@POST/", func(req Request, res *Response) error {
+		res.Write(req.Body())
+		return nil
+	})
+	address := startServer(t, NewServer(router, ServerOptions{
+		ReadHeaderTimeout: 50 * time.Millisecond,
+		ReadBodyTimeout:   50 * time.Millisecond,
+	}))
+
+	for _, raw := range []string{
+		"POST / HTTP/1.1\r\nHost: slow",
+		"POST / HTTP/1.1\r\nContent-Length: 10\r\n\r\n12345",
+	} {
+		conn, err := net.Dial("tcp", address)
+		noError(t, err)
+		_, err = conn.Write([]byte(raw))
+		noError(t, err)
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		reader := bufio.NewReader(conn)
+		res, _ := readResponse(t, reader)
+		assert(t, res.StatusCode == http.StatusRequestTimeout)
+		_, err = reader.ReadByte()
+		assert(t, err == io.EOF)
+		conn.Close()
+	}
+
+	conn, err := net.Dial("tcp", address)
+	noError(t, err)
+	defer conn.Close()
+	for i := 0; i < 3; i++ {
+		// the timeouts start over for every request.
+		time.Sleep(30 * time.Millisecond)
+		_, err = conn.Write([]byte("POST / HTTP/1.1\r\nContent-Length: 2\r\n\r\nok"))
+		noError(t, err)
+		_, body := readResponse(t, bufio.NewReader(conn))
+		assert(t, body == "ok")
+	}
+}
+
+func TestStreamingResponse(t *testing.T) {
+	router := NewRouter()
+	next := make(chan struct{})
+	disconnected := make(chan error, 1)
+	router.Register("@GET/stream", func(req Request, res *Response) error {
+		assert(t, res.Flush() == ErrNotBlocking)
+		req.HandleBlocking(func(req Request, res *Response) error {
+			res.AddHeader([2]string{"Content-Type", "text/plain"})
+			res.WriteString("first,")
+			if err := res.Flush(); err != nil {
+				return err
+			}
+			<-next
+			res.WriteString("second,")
+			if err := res.Flush(); err != nil {
+				return err
+			}
+			res.WriteString("last")
+			res.AddTrailer([2]string{"X-Done", "yes"})
+			return nil
+		})
+		return nil
+	})
+	router.Register("@GET/endless", func(req Request, res *Response) error {
+		req.HandleBlocking(func(req Request, res *Response) error {
+			chunk := strings.Repeat("x", 64<<10)
+			for {
+				res.WriteString(chunk)
+				if err := res.Flush(); err != nil {
+					disconnected <- err
+					return err
+				}
+			}
+		})
+		return nil
+	})
+	address := startTestServer(t, router)
+
+	conn, err := net.Dial("tcp", address)
+	noError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("GET /stream HTTP/1.1\r\n\r\nGET /stream HTTP/1.0\r\n\r\n"))
+	noError(t, err)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	reader := bufio.NewReader(conn)
+	res, err := http.ReadResponse(reader, nil)
+	noError(t, err)
+	assert(t, res.Header.Get("Content-Type") == "text/plain")
+	assert(t, len(res.TransferEncoding) == 1 && res.TransferEncoding[0] == "chunked")
+	first := make([]byte, len("first,"))
+	_, err = io.ReadFull(res.Body, first)
+	noError(t, err)
+	assert(t, string(first) == "first,")
+	next <- struct{}{}
+	rest, err := io.ReadAll(res.Body)
+	noError(t, err)
+	assert(t, string(rest) == "second,last")
+	assert(t, res.Trailer.Get("X-Done") == "yes")
+
+	next <- struct{}{}
+	res, body := readResponse(t, reader)
+	assert(t, res.Close && res.ContentLength == -1)
+	assert(t, body == "first,second,last")
+
+	conn, err = net.Dial("tcp", address)
+	noError(t, err)
+	_, err = conn.Write([]byte("GET /endless HTTP/1.1\r\n\r\n"))
+	noError(t, err)
+	_, err = conn.Read(make([]byte, 1024))
+	noError(t, err)
+	conn.Close()
+	select {
+	case err := <-disconnected:
+		assert(t, err != nil)
+	case <-time.After(5 * time.Second):
+		t.Fatal("flush did not fail after disconnect")
+	}
+}
+
+func TestServerSentEvents(t *testing.T) {
+	router := NewRouter()
+	done := make(chan struct{})
+	router.Register("@GET/events", func(req Request, res *Response) error {
+		req.HandleEvents(func(req Request, events *EventStream) error {
+			noError(t, events.Send(Event{ID: "2", Event: "update", Data: "a\nb"}))
+			noError(t, events.Send(Event{Data: "last " + events.LastEventID(), Retry: time.Second}))
+			noError(t, events.Comment("ping"))
+			<-events.Done()
+			close(done)
+			return nil
+		})
+		return nil
+	})
+	address := startTestServer(t, router)
+
+	conn, err := net.Dial("tcp", address)
+	noError(t, err)
+	_, err = conn.Write([]byte("GET /events HTTP/1.1\r\nLast-Event-ID: 1\r\n\r\n"))
+	noError(t, err)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	noError(t, err)
+	assert(t, res.Header.Get("Content-Type") == "text/event-stream")
+	assert(t, res.Header.Get("Cache-Control") == "no-cache")
+	expected := "id: 2\nevent: update\ndata: a\ndata: b\n\n" +
+		"retry: 1000\ndata: last 1\n\n" +
+		": ping\n\n"
+	body := make([]byte, len(expected))
+	_, err = io.ReadFull(res.Body, body)
+	noError(t, err)
+	assert(t, string(body) == expected)
+	conn.Close()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("disconnect was not detected")
+	}
+}
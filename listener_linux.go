@@ -0,0 +1,22 @@
+//go:build linux
+
+package ghttp
+
+import (
+	"github.com/panjf2000/gnet/v2"
+	"golang.org/x/sys/unix"
+)
+
+// stopAccepting makes the listener of the engine drop new connections.
+// gnet can't close a listener without closing its connections, so a
+// socket filter drops the packets of connecting clients instead.
+func stopAccepting(eng gnet.Engine) error {
+	fd, err := eng.Dup()
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd)
+	drop := []unix.SockFilter{{Code: unix.BPF_RET | unix.BPF_K, K: 0}}
+	return unix.SetsockoptSockFprog(fd, unix.SOL_SOCKET, unix.SO_ATTACH_FILTER,
+		&unix.SockFprog{Len: uint16(len(drop)), Filter: &drop[0]})
+}
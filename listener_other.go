@@ -0,0 +1,11 @@
+//go:build !linux
+
+package ghttp
+
+import "github.com/panjf2000/gnet/v2"
+
+// stopAccepting can't stop the listener without a socket filter,
+// new connections are closed by OnOpen instead.
+func stopAccepting(eng gnet.Engine) error {
+	return nil
+}
@@ -0,0 +1,149 @@
+package ghttp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+	"strconv"
+)
+
+// ErrProxyHeader is returned for connections without a valid PROXY protocol header.
+var ErrProxyHeader = errors.New("invalid proxy protocol header")
+
+const (
+	proxyV1Prefix = "PROXY "
+	// proxyV1MaxLength is the longest v1 header including CRLF.
+	proxyV1MaxLength    = 107
+	proxyV2Signature    = "\r\n\r\n\x00\r\nQUIT\n"
+	proxyV2HeaderSize   = 16
+	proxyV2CommandLocal = 0x0
+	proxyV2CommandProxy = 0x1
+)
+
+// parseProxyHeader parses the PROXY protocol v1 or v2 header at the start of data.
+// It returns the length of the header and the address of the client, which is
+// nil if the proxy didn't tell it. ErrIncompleteData is returned if the
+// header isn't received completely.
+func parseProxyHeader(data []byte) (int, net.Addr, error) {
+	if len(data) > 0 && data[0] == proxyV2Signature[0] {
+		return parseProxyV2(data)
+	}
+	return parseProxyV1(data)
+}
+
+// parseProxyV1 parses the human-readable header like
+// "PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\r\n".
+func parseProxyV1(data []byte) (int, net.Addr, error) {
+	if len(data) < len(proxyV1Prefix) && hasPrefix([]byte(proxyV1Prefix), string(data)) {
+		return 0, nil, ErrIncompleteData
+	}
+	if !hasPrefix(data, proxyV1Prefix) {
+		return 0, nil, ErrProxyHeader
+	}
+	end := bytes.Index(data, []byte("\r\n"))
+	if end < 0 {
+		if len(data) >= proxyV1MaxLength {
+			return 0, nil, ErrProxyHeader
+		}
+		return 0, nil, ErrIncompleteData
+	}
+	if end+2 > proxyV1MaxLength {
+		return 0, nil, ErrProxyHeader
+	}
+	fields := bytes.Split(data[len(proxyV1Prefix):end], []byte(" "))
+	switch string(fields[0]) {
+	case "UNKNOWN":
+		// the rest of the line is ignored.
+		return end + 2, nil, nil
+	case "TCP4", "TCP6":
+	default:
+		return 0, nil, ErrProxyHeader
+	}
+	if len(fields) != 5 {
+		return 0, nil, ErrProxyHeader
+	}
+	ip := net.ParseIP(string(fields[1]))
+	if ip == nil || (ip.To4() != nil) != (string(fields[0]) == "TCP4") || net.ParseIP(string(fields[2])) == nil {
+		return 0, nil, ErrProxyHeader
+	}
+	port, err := strconv.ParseUint(string(fields[3]), 10, 16)
+	if err != nil {
+		return 0, nil, ErrProxyHeader
+	}
+	if _, err := strconv.ParseUint(string(fields[4]), 10, 16); err != nil {
+		return 0, nil, ErrProxyHeader
+	}
+	return end + 2, &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// parseProxyV2 parses the binary header.
+func parseProxyV2(data []byte) (int, net.Addr, error) {
+	signature := data
+	if len(signature) > len(proxyV2Signature) {
+		signature = signature[:len(proxyV2Signature)]
+	}
+	if !hasPrefix([]byte(proxyV2Signature), string(signature)) {
+		return 0, nil, ErrProxyHeader
+	}
+	if len(data) < proxyV2HeaderSize {
+		return 0, nil, ErrIncompleteData
+	}
+	if data[12]>>4 != 2 {
+		return 0, nil, ErrProxyHeader
+	}
+	length := proxyV2HeaderSize + int(binary.BigEndian.Uint16(data[14:]))
+	if len(data) < length {
+		return 0, nil, ErrIncompleteData
+	}
+	addresses := data[proxyV2HeaderSize:length]
+	switch data[12] & 0xf {
+	case proxyV2CommandLocal:
+		// health checks of the proxy itself.
+		return length, nil, nil
+	case proxyV2CommandProxy:
+	default:
+		return 0, nil, ErrProxyHeader
+	}
+	family, transport := data[13]>>4, data[13]&0xf
+	var addr net.Addr
+	switch family {
+	case 0x1, 0x2:
+		size := net.IPv4len
+		if family == 0x2 {
+			size = net.IPv6len
+		}
+		if len(addresses) < 2*size+4 {
+			return 0, nil, ErrProxyHeader
+		}
+		ip := net.IP(CopyBytes(addresses[:size]))
+		port := int(binary.BigEndian.Uint16(addresses[2*size:]))
+		switch transport {
+		case 0x1:
+			addr = &net.TCPAddr{IP: ip, Port: port}
+		case 0x2:
+			addr = &net.UDPAddr{IP: ip, Port: port}
+		default:
+			return 0, nil, ErrProxyHeader
+		}
+	case 0x3:
+		if len(addresses) < 216 {
+			return 0, nil, ErrProxyHeader
+		}
+		name := addresses[:108]
+		if i := bytes.IndexByte(name, 0); i >= 0 {
+			name = name[:i]
+		}
+		network := "unix"
+		if transport == 0x2 {
+			network = "unixgram"
+		}
+		addr = &net.UnixAddr{Name: string(name), Net: network}
+	}
+	// unspecified families carry no address.
+	return length, addr, nil
+}
+
+func hasPrefix(data []byte, prefix string) bool {
+	return len(data) >= len(prefix) && string(data[:len(prefix)]) == prefix
+}
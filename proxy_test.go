@@ -0,0 +1,134 @@
+package ghttp
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+func proxyV2Header(command, family byte, addresses []byte) []byte {
+	header := append([]byte(proxyV2Signature), 0x20|command, family)
+	header = binary.BigEndian.AppendUint16(header, uint16(len(addresses)))
+	return append(header, addresses...)
+}
+
+func TestParseProxyHeader(t *testing.T) {
+	v4 := []byte{192, 0, 2, 1, 192, 0, 2, 2, 0xdc, 0x04, 0x01, 0xbb}
+	v6 := make([]byte, 36)
+	v6[15] = 1
+	v6[31] = 2
+	binary.BigEndian.PutUint16(v6[32:], 8080)
+	for _, test := range []struct {
+		header string
+		addr   string
+		err    error
+	}{
+		{"PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\r\n", "192.0.2.1:56324", nil},
+		{"PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n", "[2001:db8::1]:56324", nil},
+		{"PROXY UNKNOWN\r\n", "", nil},
+		{"PROXY UNKNOWN ffff:f...f:ffff 65535 65535\r\n", "", nil},
+		{"PRO", "", ErrIncompleteData},
+		{"PROXY TCP4 192.0.2.1", "", ErrIncompleteData},
+		{"PROXY TCP4 2001:db8::1 192.0.2.2 56324 443\r\n", "", ErrProxyHeader},
+		{"PROXY TCP4 192.0.2.1 192.0.2.2 99999 443\r\n", "", ErrProxyHeader},
+		{"PROXY UDP4 192.0.2.1 192.0.2.2 56324 443\r\n", "", ErrProxyHeader},
+		{"GET / HTTP/1.1\r\n\r\n", "", ErrProxyHeader},
+		{string(proxyV2Header(proxyV2CommandProxy, 0x11, v4)), "192.0.2.1:56324", nil},
+		{string(proxyV2Header(proxyV2CommandProxy, 0x21, v6)), "[::1]:8080", nil},
+		{string(proxyV2Header(proxyV2CommandLocal, 0x00, nil)), "", nil},
+		{string(proxyV2Header(proxyV2CommandProxy, 0x11, v4)[:20]), "", ErrIncompleteData},
+		{proxyV2Signature[:5], "", ErrIncompleteData},
+		{string(proxyV2Header(proxyV2CommandProxy, 0x11, v4[:8])), "", ErrProxyHeader},
+		{string(proxyV2Header(0x2, 0x11, v4)), "", ErrProxyHeader},
+		{"\r\n\r\nGET", "", ErrProxyHeader},
+	} {
+		n, addr, err := parseProxyHeader([]byte(test.header + "GET"))
+		if test.err == ErrIncompleteData {
+			n, addr, err = parseProxyHeader([]byte(test.header))
+		}
+		if err != test.err {
+			t.Fatalf("%q: expected %v got %v", test.header, test.err, err)
+		}
+		if err != nil {
+			continue
+		}
+		assert(t, n == len(test.header))
+		if test.addr == "" {
+			assert(t, addr == nil)
+		} else {
+			assert(t, addr != nil && addr.String() == test.addr)
+		}
+	}
+}
+
+func TestProxyProtocol(t *testing.T) {
+	router := NewRouter()
+	router.Register("@GET/", func(req Request, res *Response) error {
+		res.WriteString(req.ClientAddr().String())
+		return nil
+	})
+	address := startServer(t, NewServer(router, ServerOptions{ProxyProtocol: true}))
+
+	conn, err := net.Dial("tcp", address)
+	noError(t, err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err = conn.Write([]byte("PROXY TCP4 192.0.2.1 192.0.2.2 56324 "))
+	noError(t, err)
+	time.Sleep(10 * time.Millisecond)
+	_, err = conn.Write([]byte("443\r\nGET / HTTP/1.1\r\n\r\n"))
+	noError(t, err)
+	reader := bufio.NewReader(conn)
+	_, body := readResponse(t, reader)
+	assert(t, body == "192.0.2.1:56324")
+	_, err = conn.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+	noError(t, err)
+	_, body = readResponse(t, reader)
+	assert(t, body == "192.0.2.1:56324")
+
+	// the proxy didn't name the client.
+	conn, err = net.Dial("tcp", address)
+	noError(t, err)
+	defer conn.Close()
+	_, err = conn.Write(append(proxyV2Header(proxyV2CommandLocal, 0, nil), "GET / HTTP/1.1\r\n\r\n"...))
+	noError(t, err)
+	_, body = readResponse(t, bufio.NewReader(conn))
+	assert(t, body == conn.LocalAddr().String())
+
+	// connections without the header are closed.
+	conn, err = net.Dial("tcp", address)
+	noError(t, err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err = conn.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+	noError(t, err)
+	_, err = bufio.NewReader(conn).ReadByte()
+	assert(t, err != nil)
+}
+
+func TestProxyProtocolTLS(t *testing.T) {
+	cert, _, _ := generateCert(t, "example.com")
+	router := NewRouter()
+	router.Register("@GET/", func(req Request, res *Response) error {
+		res.WriteString(req.ClientAddr().String())
+		return nil
+	})
+	address := startServer(t, NewServer(router, ServerOptions{
+		ProxyProtocol: true,
+		TLSConfig:     &tls.Config{Certificates: []tls.Certificate{cert}},
+	}))
+	raw, err := net.Dial("tcp", address)
+	noError(t, err)
+	defer raw.Close()
+	raw.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err = raw.Write(proxyV2Header(proxyV2CommandProxy, 0x11, []byte{192, 0, 2, 1, 192, 0, 2, 2, 0, 80, 1, 187}))
+	noError(t, err)
+	conn := tls.Client(raw, &tls.Config{InsecureSkipVerify: true})
+	_, err = conn.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+	noError(t, err)
+	_, body := readResponse(t, bufio.NewReader(conn))
+	assert(t, body == "192.0.2.1:80")
+}
@@ -0,0 +1,136 @@
+package ghttp
+
+import (
+	"bytes"
+	"net"
+	"net/netip"
+)
+
+var (
+	forwarded     = []byte("Forwarded")
+	xForwardedFor = []byte("X-Forwarded-For")
+	xRealIP       = []byte("X-Real-IP")
+)
+
+// RealIP returns the IP of the client. If the peer, ClientAddr, is in
+// ServerOptions.TrustedProxies the Forwarded, X-Forwarded-For and
+// X-Real-IP headers are honored in this order. Their addresses are read
+// from the right, the first one which isn't a trusted proxy is the client.
+// It is empty if the client has no IP, like on unix sockets.
+func (r Request) RealIP() string {
+	ip := addrIP(r.ClientAddr())
+	if !ip.IsValid() {
+		return ""
+	}
+	var trusted []netip.Prefix
+	if r.codec != nil {
+		trusted = r.codec.server.options.TrustedProxies
+	}
+	if !isTrusted(trusted, ip) {
+		return ip.String()
+	}
+	if client, ok := r.forwardedIP(forwarded, forwardedFor, trusted); ok {
+		return client.String()
+	}
+	if client, ok := r.forwardedIP(xForwardedFor, parseHostIP, trusted); ok {
+		return client.String()
+	}
+	if client, ok := parseHostIP(r.parser.FindHeader(xRealIP)); ok {
+		return client.String()
+	}
+	return ip.String()
+}
+
+// forwardedIP walks the comma separated addresses of the header from the
+// right and returns the first one which isn't trusted or the last valid one.
+// Proxies may add the header multiple times, later fields come first.
+func (r Request) forwardedIP(name []byte, parse func([]byte) (netip.Addr, bool), trusted []netip.Prefix) (netip.Addr, bool) {
+	var client netip.Addr
+	found := false
+	header := r.parser.header
+	for i := len(header) - 1; i >= 0; i-- {
+		if !bytes.EqualFold(header[i][0], name) {
+			continue
+		}
+		list := header[i][1]
+		for len(list) > 0 {
+			element := list
+			list = nil
+			if j := bytes.LastIndexByte(element, ','); j >= 0 {
+				element, list = element[j+1:], element[:j]
+			}
+			addr, ok := parse(element)
+			if !ok {
+				// addresses left of an invalid one can't be trusted.
+				return client, found
+			}
+			client, found = addr, true
+			if !isTrusted(trusted, addr) {
+				return client, true
+			}
+		}
+	}
+	return client, found
+}
+
+// forwardedFor returns the address of the for parameter
+// of an RFC 7239 Forwarded element.
+func forwardedFor(element []byte) (netip.Addr, bool) {
+	for len(element) > 0 {
+		pair := element
+		element = nil
+		if j := bytes.IndexByte(pair, ';'); j >= 0 {
+			pair, element = pair[:j], pair[j+1:]
+		}
+		pair = bytes.TrimSpace(pair)
+		if len(pair) > 4 && bytes.EqualFold(pair[:4], []byte("for=")) {
+			return parseHostIP(pair[4:])
+		}
+	}
+	return netip.Addr{}, false
+}
+
+// parseHostIP parses an IP with an optional port, IPv6 addresses with
+// a port are in brackets. The value may be quoted.
+func parseHostIP(host []byte) (netip.Addr, bool) {
+	host = bytes.TrimSpace(host)
+	if len(host) >= 2 && host[0] == '"' && host[len(host)-1] == '"' {
+		host = host[1 : len(host)-1]
+	}
+	if len(host) > 0 && host[0] == '[' {
+		end := bytes.IndexByte(host, ']')
+		if end < 0 {
+			return netip.Addr{}, false
+		}
+		host = host[1:end]
+	} else if bytes.Count(host, []byte(":")) == 1 {
+		host = host[:bytes.IndexByte(host, ':')]
+	}
+	addr, err := netip.ParseAddr(*unsafeString(&host))
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addr.Unmap(), true
+}
+
+func isTrusted(trusted []netip.Prefix, ip netip.Addr) bool {
+	for _, prefix := range trusted {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// addrIP returns the IP of a TCP or UDP address.
+func addrIP(addr net.Addr) netip.Addr {
+	var ip net.IP
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		ip = addr.IP
+	case *net.UDPAddr:
+		ip = addr.IP
+	}
+	parsed, _ := netip.AddrFromSlice(ip)
+	return parsed.Unmap()
+}
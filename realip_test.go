@@ -0,0 +1,45 @@
+package ghttp
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+)
+
+func TestRealIP(t *testing.T) {
+	server := NewServer(NewRouter(), ServerOptions{TrustedProxies: []netip.Prefix{
+		netip.MustParsePrefix("10.0.0.0/8"),
+		netip.MustParsePrefix("2001:db8::/32"),
+	}})
+	for _, test := range []struct {
+		peer   string
+		header string
+		ip     string
+	}{
+		{"192.0.2.1", "X-Forwarded-For: 198.51.100.1\r\n", "192.0.2.1"},
+		{"10.0.0.1", "", "10.0.0.1"},
+		{"10.0.0.1", "X-Forwarded-For: 198.51.100.1\r\n", "198.51.100.1"},
+		{"10.0.0.1", "X-Forwarded-For: 203.0.113.9, 198.51.100.1, 10.0.0.2\r\n", "198.51.100.1"},
+		{"10.0.0.1", "X-Forwarded-For: 10.0.0.3, 10.0.0.2\r\n", "10.0.0.3"},
+		{"10.0.0.1", "X-Forwarded-For: 203.0.113.9\r\nX-Forwarded-For: 198.51.100.1\r\n", "198.51.100.1"},
+		{"10.0.0.1", "X-Forwarded-For: spoofed, 10.0.0.2\r\n", "10.0.0.2"},
+		{"10.0.0.1", "X-Forwarded-For: 198.51.100.1:4711\r\n", "198.51.100.1"},
+		{"10.0.0.1", "X-Real-IP: 198.51.100.7\r\n", "198.51.100.7"},
+		{"10.0.0.1", "X-Real-IP: invalid\r\n", "10.0.0.1"},
+		{"10.0.0.1", "Forwarded: for=192.0.2.60;proto=http;by=203.0.113.43\r\n", "192.0.2.60"},
+		{"10.0.0.1", "Forwarded: for=198.51.100.1, For=\"[2001:db8:cafe::17]:4711\"\r\n", "198.51.100.1"},
+		{"10.0.0.1", "Forwarded: for=unknown\r\nX-Forwarded-For: 198.51.100.1\r\n", "198.51.100.1"},
+		{"10.0.0.1", "Forwarded: for=192.0.2.60\r\nX-Forwarded-For: 198.51.100.1\r\n", "192.0.2.60"},
+		{"::ffff:10.0.0.1", "X-Forwarded-For: ::ffff:198.51.100.1\r\n", "198.51.100.1"},
+	} {
+		req := parsedRequest(t, "GET / HTTP/1.1\r\n"+test.header+"\r\n")
+		req.codec = &httpCodec{server: server, clientAddr: &net.TCPAddr{IP: net.ParseIP(test.peer), Port: 80}}
+		if ip := req.RealIP(); ip != test.ip {
+			t.Fatalf("%s %q: expected %s got %s", test.peer, test.header, test.ip, ip)
+		}
+	}
+
+	req := parsedRequest(t, "GET / HTTP/1.1\r\n\r\n")
+	req.codec = &httpCodec{server: server, clientAddr: &net.UnixAddr{Name: "@", Net: "unix"}}
+	assert(t, req.RealIP() == "")
+}
@@ -2,6 +2,8 @@ package ghttp
 
 import (
 	"bytes"
+	"io"
+	"net"
 
 	"github.com/panjf2000/gnet/v2"
 )
@@ -14,11 +16,17 @@ import (
 // or use HandleBlocking to do blocking
 // tasks like DB operations to avoid blocking the I/O loop.
 type Request struct {
-	conn      gnet.Conn
-	parser    *httpParser
-	data      []byte
-	detached  *bool
-	response  *Response
+	router   *Router
+	codec    *httpCodec
+	route    *branch
+	rest     int
+	conn     gnet.Conn
+	parser   *httpParser
+	stream   *bodyStream
+	h2       *h2Stream
+	detached *bool
+	handoff  *handoff
+	response *Response
 }
 
 // Header returns the value of the header name.
@@ -28,22 +36,76 @@ func (r Request) Header(header string) string {
 	return string(r.parser.FindHeader([]byte(header)))
 }
 
+// Trailer returns the value of the trailer name sent after
+// a chunked request body.
+// For streamed bodies trailers are available once
+// the body has been read completely.
+//
+// To keep this value longer than the request use CopyString.
+func (r Request) Trailer(trailer string) string {
+	if r.stream != nil {
+		return string(r.stream.findTrailer([]byte(trailer)))
+	}
+	return string(r.parser.FindTrailer([]byte(trailer)))
+}
+
 var mt []byte
 
 // Body returns the data of the request body.
 //
 // To keep this value longer than the request use CopyBytes.
 func (r Request) Body() []byte {
-	return r.data
+	return r.parser.body
+}
+
+// BodyReader returns a reader over the request body.
+//
+// For routes registered with Router.RegisterStream the body
+// is read while it is still being received.
+func (r Request) BodyReader() io.Reader {
+	if r.stream != nil {
+		return r.stream
+	}
+	return bytes.NewReader(r.parser.body)
 }
 
 var contentLength = []byte("Content-Length")
 
 // BodyLength returns the length of the request body.
+// It is -1 for a chunked body which is still being streamed.
 func (r Request) BodyLength() int64 {
+	if r.h2 != nil {
+		return int64(len(r.parser.body))
+	}
+	if r.parser.chunked {
+		if r.stream != nil {
+			return -1
+		}
+		return int64(len(r.parser.body))
+	}
 	return BytesToInt(r.parser.FindHeader(contentLength))
 }
 
+// LocalAddr returns the address of the listener which accepted the connection.
+func (r Request) LocalAddr() net.Addr {
+	return r.conn.LocalAddr()
+}
+
+// RemoteAddr returns the address of the client connection.
+func (r Request) RemoteAddr() net.Addr {
+	return r.conn.RemoteAddr()
+}
+
+// ClientAddr returns the address of the client. It is the address named
+// by the PROXY protocol header if ServerOptions.ProxyProtocol is set and
+// the proxy sent one, RemoteAddr otherwise.
+func (r Request) ClientAddr() net.Addr {
+	if r.codec != nil && r.codec.clientAddr != nil {
+		return r.codec.clientAddr
+	}
+	return r.RemoteAddr()
+}
+
 var host = []byte("Host")
 
 // Host returns the request host retrieved from the header parameter "Host"
@@ -62,6 +124,55 @@ func (r Request) Path() string {
 	return *unsafeString(&r.parser.path)
 }
 
+// Query returns the decoded value of the first query parameter name
+// or an empty string if it isn't present.
+//
+// To keep this value longer than the request use CopyString.
+func (r Request) Query(name string) string {
+	value, _ := r.parser.FindQuery([]byte(name))
+	return *unsafeString(&value)
+}
+
+// QueryInt returns the first query parameter name parsed as an int64.
+func (r Request) QueryInt(name string) int64 {
+	value, _ := r.parser.FindQuery([]byte(name))
+	return BytesToInt(value)
+}
+
+// HasQuery reports whether the query parameter name is present.
+func (r Request) HasQuery(name string) bool {
+	_, ok := r.parser.FindQuery([]byte(name))
+	return ok
+}
+
+// QueryAll returns the decoded values of every query parameter name
+// in the order they appear in the request.
+//
+// To keep the values longer than the request use CopyString.
+func (r Request) QueryAll(name string) []string {
+	var values []string
+	r.VisitQuery(func(key, value string) bool {
+		if key == name {
+			values = append(values, value)
+		}
+		return true
+	})
+	return values
+}
+
+// VisitQuery calls fn for every decoded query parameter in the order they
+// appear in the request until fn returns false.
+//
+// To keep the values longer than the request use CopyString.
+func (r Request) VisitQuery(fn func(name, value string) bool) {
+	r.parser.decodeQuery()
+	for _, pair := range r.parser.query {
+		if !fn(*unsafeString(&pair[0]), *unsafeString(&pair[1])) {
+			return
+		}
+	}
+}
+
 // Method returns the request method of the request
 // defined as the constants MethodGet and similar.
 func (r Request) Method() int {
@@ -70,28 +181,85 @@ func (r Request) Method() int {
 
 // HandleBlocking runs this handler outside of the
 // I/O loop.
+// Pipelined requests on the same connection are
+// answered after the response of this handler.
+//
+// The middleware of the route run around the handler, the error of
+// the handler is returned by next unless the route handler returns
+// its own. The response is sent once the middleware returned.
 func (r Request) HandleBlocking(fn HandlerFunc) {
+	h := r.handoff
+	if h == nil {
+		r.detach(fn)
+		return
+	}
+	if !h.detached {
+		r.own()
+		r.response.stream = newResponseStream(r.conn, r.codec)
+		r.response.stream.h2 = r.h2
+		h.detached = true
+		// the event loop continues with the next request.
+		h.done <- true
+	}
+	h.err = fn(r, r.response)
+}
+
+// detach runs fn outside of the I/O loop, the response is sent
+// once it returned.
+func (r Request) detach(fn HandlerFunc) {
 	*r.detached = true
-	r.data = CopyBytes(r.data)
-	r.response.headers = [][2]string{}
+	r.parser = r.parser.clone()
+	r.response.stream = newResponseStream(r.conn, r.codec)
+	r.response.stream.h2 = r.h2
+	server := r.codec.server
+	server.blocking.Add(1)
 	go func() {
-		err := fn(r, r.response)
-		if err != nil {
-			r.response.status = 500
-			r.response.body.Reset()
-			r.response.Write([]byte("Internal Server Error"))
-		}
-		bytes := bytePool.Get().(*bytes.Buffer)
-		r.response.renderResponse(bytes)
-		r.conn.AsyncWrite(bytes.Bytes(), func(c gnet.Conn, err error) error {
-			bytes.Reset()
-			bytePool.Put(bytes)
-			returnResponse(r.response)
-			return nil
-		})
+		defer server.blocking.Add(-1)
+		r.finish(r.router.serve(fn, r, r.response))
 	}()
 }
 
+// own copies the request data which the event loop reuses
+// for the next request of the connection.
+func (r Request) own() {
+	p := r.parser
+	if r.h2 == nil {
+		// the connection continues with a new parser.
+		r.codec.parser = NewHTTPParser()
+		r.codec.parser.limits = p.limits
+	}
+	// the trailers are shared with the chunked decoder.
+	p.trailer = append([]pair(nil), p.trailer...)
+	p.retain(nil)
+	p.body = CopyBytes(p.body)
+}
+
+// finish sends the response of a blocking handler which returned err.
+func (r Request) finish(err error) {
+	if err != nil && !r.response.stream.started {
+		r.router.handleError(r, r.response, err)
+		err = nil
+	}
+	if r.response.stream.started {
+		// the error handler may have flushed too.
+		r.response.finish(err)
+		return
+	}
+	if r.h2 != nil {
+		r.h2.conn.respondAsync(r.h2, r.response)
+		return
+	}
+	bytes := bytePool.Get().(*bytes.Buffer)
+	r.response.renderResponse(bytes)
+	r.codec.server.asyncWrite(r.conn, r.codec, bytes.Bytes(), func(c gnet.Conn, err error) error {
+		bytes.Reset()
+		bytePool.Put(bytes)
+		returnResponse(r.response)
+		resume(c)
+		return nil
+	})
+}
+
 // PathSequence returns the nth element of the path.
 //
 // To keep this value longer than the request use CopyBytes.
@@ -120,3 +288,37 @@ func (r Request) PathSequence(n int) []byte {
 func (r Request) PathInt(n int) int64 {
 	return BytesToInt(r.PathSequence(n))
 }
+
+// Param returns the part of the path named name in the route.
+//
+// To keep this value longer than the request use CopyBytes.
+func (r Request) Param(name string) []byte {
+	if r.route == nil {
+		return []byte{}
+	}
+	for _, param := range r.route.params {
+		if param.name == name && param.rest {
+			return r.PathRest()
+		}
+		if param.name == name {
+			return r.PathSequence(param.index)
+		}
+	}
+	return []byte{}
+}
+
+// ParamInt returns the part of the path named name parsed as an int64.
+func (r Request) ParamInt(name string) int64 {
+	return BytesToInt(r.Param(name))
+}
+
+// PathRest returns the rest of the path matched by a trailing **
+// in the route, it is empty for other routes.
+//
+// To keep this value longer than the request use CopyBytes.
+func (r Request) PathRest() []byte {
+	if r.route == nil || r.rest >= len(r.parser.path) {
+		return []byte{}
+	}
+	return r.parser.path[r.rest:]
+}
@@ -0,0 +1,40 @@
+package ghttp
+
+import (
+	"testing"
+)
+
+func parsedRequest(t *testing.T, raw string) Request {
+	hp := NewHTTPParser()
+	n, err := hp.Parse([]byte(raw))
+	noError(t, err)
+	hp.body = []byte(raw[n:])
+	return Request{parser: hp}
+}
+
+func TestRequestQuery(t *testing.T) {
+	req := parsedRequest(t, "GET /?id=42&name=J%C3%B6rg&tag=a&tag=b+c HTTP/1.1\r\n\r\n")
+
+	assert(t, req.QueryInt("id") == 42)
+	assert(t, req.Query("name") == "Jörg")
+	assert(t, req.Query("missing") == "")
+	assert(t, req.HasQuery("tag"))
+	tags := req.QueryAll("tag")
+	assert(t, len(tags) == 2 && tags[0] == "a" && tags[1] == "b c")
+
+	count := 0
+	req.VisitQuery(func(name, value string) bool {
+		count++
+		return name != "name"
+	})
+	assert(t, count == 2)
+}
+
+func TestRequestQueryNoAllocs(t *testing.T) {
+	req := parsedRequest(t, "GET /?id=42&name=a%20b HTTP/1.1\r\n\r\n")
+	allocs := testing.AllocsPerRun(100, func() {
+		req.Query("name")
+		req.QueryInt("id")
+	})
+	assert(t, allocs == 0)
+}
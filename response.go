@@ -9,9 +9,19 @@ import (
 
 // Response descripes an HTTP response.
 type Response struct {
-	status  int
-	body    bytes.Buffer
-	headers [][2]string
+	status   int
+	body     bytes.Buffer
+	headers  [][2]string
+	chunked  bool
+	trailers [][2]string
+	// http10 is set for HTTP/1.0 requests which don't
+	// understand chunked responses.
+	http10 bool
+	// close is set if the connection is closed after the response.
+	close bool
+	// stream is set for responses of blocking handlers
+	// which can be flushed.
+	stream *responseStream
 }
 
 // Write appends the bytes b to the response body.
@@ -37,22 +47,77 @@ func (r *Response) AddHeader(header [2]string) *Response {
 	return r
 }
 
+// Chunked sends the body with chunked transfer encoding
+// instead of a Content-Length header.
+// Clients speaking HTTP/1.0 still receive a Content-Length.
+func (r *Response) Chunked() *Response {
+	r.chunked = true
+	return r
+}
+
+// AddTrailer adds the key value pair of {key value} to the trailer
+// sent after the body. This switches the response to chunked
+// encoding as trailers can't be sent otherwise.
+func (r *Response) AddTrailer(trailer [2]string) *Response {
+	r.chunked = true
+	r.trailers = append(r.trailers, trailer)
+	return r
+}
+
 func (r *Response) renderResponse(into *bytes.Buffer) {
+	r.renderStatus(into)
+	if r.status == http.StatusSwitchingProtocols {
+		// the connection speaks another protocol now.
+		into.WriteString("\r\n")
+		return
+	}
+	if r.chunked && !r.http10 {
+		r.renderTrailerHeader(into)
+		into.WriteString("Transfer-Encoding: chunked\r\n\r\n")
+		writeChunk(into, r.body.Bytes())
+		writeLastChunk(into, r.trailers)
+		return
+	}
+	into.WriteString("Content-Length: ")
+	into.WriteString(strconv.Itoa(r.body.Len()))
+	into.WriteString("\r\n\r\n")
+	into.Write(r.body.Bytes())
+}
+
+// renderStatus writes the status line and headers
+// without the framing of the body.
+func (r *Response) renderStatus(into *bytes.Buffer) {
 	into.WriteString("HTTP/1.1 ")
 	into.WriteString(strconv.Itoa(r.status))
 	into.WriteByte(' ')
 	into.WriteString(http.StatusText(r.status))
 	into.WriteString("\r\nServer: ghttp over gnet\r\n")
+	if r.close {
+		into.WriteString("Connection: close\r\n")
+	} else if r.http10 {
+		into.WriteString("Connection: keep-alive\r\n")
+	}
 	for _, header := range r.headers {
 		into.WriteString(header[0])
 		into.WriteString(": ")
 		into.WriteString(header[1])
 		into.WriteString("\r\n")
 	}
-	into.WriteString("Content-Length: ")
-	into.WriteString(strconv.Itoa(r.body.Len()))
-	into.WriteString("\r\n\r\n")
-	into.Write(r.body.Bytes())
+}
+
+// renderTrailerHeader announces the trailer names.
+func (r *Response) renderTrailerHeader(into *bytes.Buffer) {
+	if len(r.trailers) == 0 {
+		return
+	}
+	into.WriteString("Trailer: ")
+	for i, trailer := range r.trailers {
+		if i > 0 {
+			into.WriteString(", ")
+		}
+		into.WriteString(trailer[0])
+	}
+	into.WriteString("\r\n")
 }
 
 var responsePool = sync.Pool{
@@ -69,6 +134,11 @@ func returnResponse(resp *Response) {
 	resp.status = 200
 	resp.body.Reset()
 	resp.headers = resp.headers[:0]
+	resp.chunked = false
+	resp.trailers = resp.trailers[:0]
+	resp.http10 = false
+	resp.close = false
+	resp.stream = nil
 	responsePool.Put(resp)
 }
 
@@ -1,6 +1,7 @@
 package ghttp
 
 import (
+	"net/http"
 	"strings"
 	"sync"
 	"unsafe"
@@ -11,6 +12,10 @@ import (
 // HandlerFunc handles HTTP Requests
 type HandlerFunc = func(req Request, res *Response) error
 
+// MiddlewareFunc wraps a handler to run code before or after it.
+// A middleware can short-circuit the request by not calling next.
+type MiddlewareFunc = func(next HandlerFunc) HandlerFunc
+
 // Router is the core element of a HTTP Server and navigates
 // the requests.
 //
@@ -33,14 +38,44 @@ type HandlerFunc = func(req Request, res *Response) error
 //
 // The * matches anything. The method Request.PathSequence can be used
 // to get the data.
+//
+// A trailing ** matches the rest of the path including further slashes.
+// The method Request.PathRest can be used to get the rest:
+//
+//	@GET/static/**
+//
+// will match /static/css/main.css with the rest css/main.css.
+// More specific routes are preferred over the **.
+//
+// Any part can be named by wrapping it in braces {name:part}, a part
+// without a pattern {name} matches anything like *. For example:
+//
+//	@GET/users/{id:#}/posts/{slug}
+//
+// The methods Request.Param and Request.ParamInt return the named parts.
 type Router struct {
-	routes routerRoot
+	routes     *routerRoot
+	parent     *Router
+	prefix     string
+	method     int
+	middleware []MiddlewareFunc
+	// registered is set once a route was registered
+	// on this router or one of its groups.
+	registered bool
+
+	notFound         HandlerFunc
+	methodNotAllowed HandlerFunc
+	errorHandler     ErrorHandlerFunc
 }
 
 // NewRouter creates a new router
 func NewRouter() *Router {
 	return &Router{
-		[methodCount]branch{
+		method:           MethodUnkown,
+		notFound:         notFound,
+		methodNotAllowed: methodNotAllowed,
+		errorHandler:     DefaultErrorHandler,
+		routes: &routerRoot{
 			createBranch(),
 			createBranch(),
 			createBranch(),
@@ -55,84 +90,346 @@ func NewRouter() *Router {
 	}
 }
 
+// Group returns a router registering its routes below the prefix.
+// The prefix may start with a @METHOD to guard all routes of the group:
+//
+//	api := router.Group("@GET/api/v1")
+//	api.Register("/users/#", handler) // @GET/api/v1/users/#
+//
+// The routes of the group are added to this router and run the middleware
+// of this router followed by the middleware added to the group with Use.
+func (router *Router) Group(prefix string) *Router {
+	method, path := splitMethod(prefix)
+	if method == MethodUnkown {
+		method = router.method
+	}
+	return &Router{
+		routes: router.routes,
+		parent: router,
+		prefix: router.prefix + "/" + strings.Trim(path, "/"),
+		method: method,
+	}
+}
+
+// NotFound sets the handler for requests without a matching route.
+// The status is already set to 404 when it is called.
+func (router *Router) NotFound(handler HandlerFunc) {
+	router.root().notFound = handler
+}
+
+// MethodNotAllowed sets the handler for requests whose path only matches
+// routes of other methods. The status is already set to 405 and
+// the Allow header lists the methods of these routes when it is called.
+func (router *Router) MethodNotAllowed(handler HandlerFunc) {
+	router.root().methodNotAllowed = handler
+}
+
+// ErrorHandler sets the handler answering errors returned by handlers,
+// the DefaultErrorHandler is used otherwise.
+func (router *Router) ErrorHandler(handler ErrorHandlerFunc) {
+	router.root().errorHandler = handler
+}
+
+func (router *Router) root() *Router {
+	for router.parent != nil {
+		router = router.parent
+	}
+	return router
+}
+
+// allowed lists the methods with a route matching the path.
+func (router *Router) allowed(path []byte) string {
+	allowed := ""
+	for method := 0; method < MethodUnkown; method++ {
+		if route, _ := router.findRoute(method, path); route == nil {
+			continue
+		}
+		if allowed != "" {
+			allowed += ", "
+		}
+		allowed += methodNames[method]
+	}
+	return allowed
+}
+
+func notFound(req Request, res *Response) error {
+	res.WriteString("Not Found")
+	return nil
+}
+
+func methodNotAllowed(req Request, res *Response) error {
+	res.WriteString("Method Not Allowed")
+	return nil
+}
+
+// Use adds middleware to the routes of the router and its groups.
+// It panics if routes were registered on them already, middleware
+// have to be added first.
+//
+// Middleware run in the order they were added, the first one
+// being the outermost, the middleware of a group run after the ones
+// of its parent. The NotFound and MethodNotAllowed handlers run in the
+// middleware of the router passed to the server.
+// They run once around the route handler. Routes with middleware are
+// served outside of the I/O loop, so the middleware continue around a
+// handler passed to Request.HandleBlocking.
+func (router *Router) Use(middleware ...MiddlewareFunc) {
+	if router.registered {
+		panic("ghttp: Use after routes were registered")
+	}
+	router.middleware = append(router.middleware, middleware...)
+}
+
 // Register setups the router to handle requests for the given route
 func (router *Router) Register(route string, handler HandlerFunc) {
-	addBranch(route, &router.routes, handler)
-}
-
-func (router *Router) findRoute(r Request, path []byte) HandlerFunc {
-	method := r.Method()
-	branch := router.routes[method]
-	start := 1
-	for start < len(path) {
-		end := len(path)
-		for i := start; i < len(path); i++ {
-			if path[i] == '/' {
-				end = i
-				break
-			}
+	router.register()
+	addBranch(router.route(route), router.routes, handler, router.chain(), false)
+}
+
+// RegisterStream setups the router to handle requests for the given route
+// as soon as their header arrived.
+// The handler is run outside of the I/O loop like with Request.HandleBlocking
+// and reads the body while it is received using Request.BodyReader.
+// At most 4 MB are buffered ahead of the handler, the body reader fails
+// with ErrSlowStream if the client sends faster than it is read.
+func (router *Router) RegisterStream(route string, handler HandlerFunc) {
+	router.register()
+	addBranch(router.route(route), router.routes, handler, router.chain(), true)
+}
+
+// register marks the router and its parents, their middleware
+// are part of the route now.
+func (router *Router) register() {
+	for ; router != nil; router = router.parent {
+		router.registered = true
+	}
+}
+
+// route prefixes the route with the prefix and method guard of the group.
+func (router *Router) route(route string) string {
+	if router.parent == nil {
+		return route
+	}
+	method, path := splitMethod(route)
+	if method == MethodUnkown {
+		method = router.method
+	} else if router.method != MethodUnkown && method != router.method {
+		panic("ghttp: route " + route + " conflicts with the method of its group")
+	}
+	path = router.prefix + "/" + strings.TrimLeft(path, "/")
+	if method == MethodUnkown {
+		return path
+	}
+	return "@" + methodNames[method] + path
+}
+
+// chain returns the middleware of the router and its parents.
+func (router *Router) chain() []MiddlewareFunc {
+	if router.parent == nil {
+		return router.middleware
+	}
+	parent := router.parent.chain()
+	chain := make([]MiddlewareFunc, 0, len(parent)+len(router.middleware))
+	chain = append(chain, parent...)
+	return append(chain, router.middleware...)
+}
+
+// splitMethod splits the @METHOD from a route.
+func splitMethod(route string) (int, string) {
+	trimmed := strings.TrimLeft(route, "/")
+	if !strings.HasPrefix(trimmed, "@") {
+		return MethodUnkown, route
+	}
+	method, path, _ := strings.Cut(trimmed, "/")
+	return requestMethod([]byte(strings.ToUpper(method[1:]))), "/" + path
+}
+
+// wrap returns handler wrapped in the middleware.
+func wrap(middleware []MiddlewareFunc, handler HandlerFunc) HandlerFunc {
+	for i := len(middleware) - 1; i >= 0; i-- {
+		handler = middleware[i](handler)
+	}
+	return handler
+}
+
+// streams reports whether the route of the parsed request
+// reads its body as a stream.
+func (router *Router) streams(p *httpParser) bool {
+	branch, _ := router.findRoute(p.method, p.path)
+	return branch != nil && branch.stream
+}
+
+// findRoute returns the branch handling the path and
+// the offset of the path matched by a trailing **.
+func (router *Router) findRoute(method int, path []byte) (*branch, int) {
+	return matchBranch(&router.routes[method], path, 1)
+}
+
+func matchBranch(b *branch, path []byte, start int) (*branch, int) {
+	if start >= len(path) {
+		if b.handler != nil {
+			return b, len(path)
 		}
-		part := path[start:end]
-		maybeBranch, ok := branch.fixed[*unsafeString(&part)]
-		if !ok {
-			for _, dynamic := range branch.dynamic {
-				if dynamic.matcher(part) {
-					branch = *dynamic
-					ok = true
-					break
-				}
-			}
-			if !ok {
-				return nil
+		if b.catchAll != nil {
+			return b.catchAll, len(path)
+		}
+		return nil, 0
+	}
+	end := len(path)
+	for i := start; i < len(path); i++ {
+		if path[i] == '/' {
+			end = i
+			break
+		}
+	}
+	part := path[start:end]
+	if next, ok := b.fixed[*unsafeString(&part)]; ok {
+		if match, rest := matchBranch(next, path, end+1); match != nil {
+			return match, rest
+		}
+	}
+	for _, dynamic := range b.dynamic {
+		if dynamic.matcher(part) {
+			if match, rest := matchBranch(dynamic, path, end+1); match != nil {
+				return match, rest
 			}
-		} else {
-			branch = *maybeBranch
 		}
-		start = end + 1
 	}
-	return branch.handler
+	if b.catchAll != nil {
+		return b.catchAll, start
+	}
+	return nil, 0
 }
 
 var signalPool = sync.Pool{New: func() any { return new(bool) }}
 
-func (router *Router) call(conn gnet.Conn, p *httpParser, body []byte) bool {
+// call handles the request and renders the response into the buffer of the
+// codec unless it was detached. close is set if the connection is closed
+// after the response.
+func (router *Router) call(conn gnet.Conn, p *httpParser, body []byte, stream *bodyStream) (detached bool, close bool) {
+	hc := conn.Context().(*httpCodec)
 	response := getResponse()
+	response.http10 = p.version < HTTP1_1
+	response.close = !p.keepAlive() || hc.server.closing.Load()
+	close = response.close
 
 	request := Request{
+		router:   router,
+		codec:    hc,
 		conn:     conn,
 		parser:   p,
-		data:     body,
-		detached: signalPool.Get().(*bool),
+		stream:   stream,
 		response: response,
 	}
+	p.body = body
+	if detached = router.handle(request); detached {
+		// the response is sent by the blocking handler.
+		return
+	}
+	if hc.upgrade != nil && response.status != http.StatusSwitchingProtocols {
+		// the upgrade was replaced by an error.
+		hc.upgrade = nil
+	}
+	response.renderResponse(hc.buf)
+	returnResponse(response)
+	return
+}
 
-	handler := router.findRoute(request, p.path)
-	hc := conn.Context().(*httpCodec)
+// handle routes the request and runs its handler or the error handler
+// if it fails. It reports whether the request was detached, the blocking
+// handler owns the response then.
+func (router *Router) handle(request Request) (detached bool) {
+	p, response := request.parser, request.response
+	route, rest := router.findRoute(p.method, p.path)
+	request.route, request.rest = route, rest
+	request.detached = signalPool.Get().(*bool)
 
-	if handler == nil {
+	var err error
+	handedOff := false
+	if route == nil {
+		handler := router.notFound
 		response.status = 404
-		response.Write([]byte("Not Found"))
-		response.renderResponse(hc.buf)
-		returnResponse(response)
-		return false
+		if allowed := router.allowed(p.path); allowed != "" {
+			handler = router.methodNotAllowed
+			response.status = 405
+			response.AddHeader([2]string{"Allow", allowed})
+		}
+		if len(router.middleware) > 0 {
+			handedOff, err = router.serveHandoff(wrap(router.middleware, blockingResult(handler)), request)
+		} else {
+			err = router.serve(handler, request, response)
+		}
+	} else if route.stream {
+		request.detach(route.handler)
+	} else if route.handoff {
+		handedOff, err = router.serveHandoff(route.handler, request)
+	} else {
+		err = router.serve(route.handler, request, response)
 	}
 
-	err := handler(request, response)
-	if err != nil {
-		response.status = 500
-		response.body.Reset()
-		response.Write([]byte("Internal Server Error"))
+	detached = handedOff || *request.detached
+	*request.detached = false
+	signalPool.Put(request.detached)
+	if err != nil && !detached {
+		router.handleError(request, response, err)
 	}
+	return
+}
+
+// handoff releases the event loop waiting for a chain served
+// by serveHandoff.
+type handoff struct {
+	// done receives whether the handler was detached.
+	done     chan bool
+	detached bool
+	// err is returned by the handler passed to Request.HandleBlocking.
+	err error
+}
+
+var handoffPool = sync.Pool{New: func() any { return &handoff{done: make(chan bool)} }}
 
-	if *request.detached {
-		signalPool.Put(request.detached)
-		returnResponse(response)
-		return true
+// serveHandoff runs the handler of a route with middleware outside of the
+// event loop, which waits until the handler returns or calls
+// Request.HandleBlocking. It reports whether the request was detached,
+// the middleware then continue around the blocking handler and the
+// response is sent once they returned.
+func (router *Router) serveHandoff(handler HandlerFunc, request Request) (detached bool, err error) {
+	h := handoffPool.Get().(*handoff)
+	request.handoff = h
+	server := request.codec.server
+	server.blocking.Add(1)
+	go func() {
+		defer server.blocking.Add(-1)
+		err := router.serve(handler, request, request.response)
+		if !h.detached {
+			h.err = err
+			h.done <- false
+			return
+		}
+		request.finish(err)
+		h.detached, h.err = false, nil
+		handoffPool.Put(h)
+	}()
+	if <-h.done {
+		// h belongs to the handler now.
+		return true, nil
+	}
+	err = h.err
+	h.err = nil
+	handoffPool.Put(h)
+	return false, err
+}
+
+// blockingResult returns the error of the handler passed to
+// Request.HandleBlocking to the middleware around handler.
+func blockingResult(handler HandlerFunc) HandlerFunc {
+	return func(req Request, res *Response) error {
+		err := handler(req, res)
+		if err == nil && req.handoff != nil && req.handoff.detached {
+			return req.handoff.err
+		}
+		return err
 	}
-	signalPool.Put(request.detached)
-	response.renderResponse(hc.buf)
-	returnResponse(response)
-	return false
 }
 
 func unsafeString(b *[]byte) *string {
@@ -147,10 +444,38 @@ type matcher = func(part []byte) bool
 type routerRoot = [methodCount]branch
 
 type branch struct {
-	matcher matcher
-	fixed   map[string]*branch
-	dynamic []*branch
+	matcher  matcher
+	pattern  string
+	fixed    map[string]*branch
+	dynamic  []*branch
+	catchAll *branch
+	// handler is wrapped in the middleware.
 	handler HandlerFunc
+	stream  bool
+	// handoff is set for handlers with middleware, they are
+	// served by serveHandoff.
+	handoff bool
+	params  []routeParam
+}
+
+// routeParam names the part of the path at index
+// or the rest of the path matched by **.
+type routeParam struct {
+	name  string
+	index int
+	rest  bool
+}
+
+// paramName splits a named part {name:pattern} into its name and pattern.
+func paramName(part string) (string, string) {
+	if len(part) < 2 || part[0] != '{' || part[len(part)-1] != '}' {
+		return "", part
+	}
+	name, pattern, found := strings.Cut(part[1:len(part)-1], ":")
+	if !found || pattern == "" {
+		pattern = "*"
+	}
+	return name, pattern
 }
 
 func methodMatcher(pathParts []string) ([]string, int) {
@@ -164,10 +489,13 @@ func methodMatcher(pathParts []string) ([]string, int) {
 }
 
 func dropEmpty(pathParts []string) []string {
-	if len(pathParts) > 0 && pathParts[0] == "" {
-		return dropEmpty(pathParts[1:])
+	parts := pathParts[:0]
+	for _, part := range pathParts {
+		if part != "" {
+			parts = append(parts, part)
+		}
 	}
-	return pathParts
+	return parts
 }
 
 func createBranch() branch {
@@ -177,6 +505,14 @@ func createBranch() branch {
 func appendStage(parts []string, b *branch) ([]string, *branch) {
 	new := createBranch()
 	part := parts[0]
+	if part == "**" {
+		if len(parts) > 1 {
+			panic("ghttp: ** must be the last part of a route")
+		}
+		new.pattern = "**"
+		b.catchAll = &new
+		return parts[1:], &new
+	}
 	if !(part[0] == '[' && part[len(part)-1] == ']') && part[0] != '#' && part[0] != '*' {
 		b.fixed[part] = &new
 		return parts[1:], &new
@@ -195,11 +531,13 @@ func appendStage(parts []string, b *branch) ([]string, *branch) {
 	}
 	if part[0] == '#' {
 		new.matcher = isNum
+		new.pattern = "#"
 		b.dynamic = append(b.dynamic, &new)
 		return parts[1:], &new
 	}
 	if part[0] == '*' {
 		new.matcher = alwaysMatch
+		new.pattern = "*"
 		b.dynamic = append(b.dynamic, &new)
 		return parts[1:], &new
 	}
@@ -227,30 +565,71 @@ func mergeBranch(b *branch, o *branch) *branch {
 		}
 		b.fixed[k] = v
 	}
-	b.handler = o.handler
+	if o.handler != nil {
+		b.handler = o.handler
+		b.stream = o.stream
+		b.handoff = o.handoff
+		b.params = o.params
+	}
 	b.matcher = o.matcher
+	b.pattern = o.pattern
+	if o.catchAll != nil {
+		if b.catchAll != nil {
+			mergeBranch(b.catchAll, o.catchAll)
+		} else {
+			b.catchAll = o.catchAll
+		}
+	}
 
-	b.dynamic = append(b.dynamic, o.dynamic...)
+dynamic:
+	for _, v := range o.dynamic {
+		for _, d := range b.dynamic {
+			if d.pattern == v.pattern {
+				mergeBranch(d, v)
+				continue dynamic
+			}
+		}
+		b.dynamic = append(b.dynamic, v)
+	}
 	return b
 }
 
-func addBranch(path string, router *routerRoot, handler HandlerFunc) {
+func addBranch(path string, router *routerRoot, handler HandlerFunc, middleware []MiddlewareFunc, stream bool) {
 	parts := strings.Split(path, "/")
 	parts = dropEmpty(parts)
 	parts, methodGuard := methodMatcher(parts)
 	parts = dropEmpty(parts)
-	b := createBranch()
-	branch := &b
-	for len(parts) > 0 {
-		parts, branch = appendStage(parts, branch)
+	if len(middleware) > 0 {
+		handler = wrap(middleware, blockingResult(handler))
+	}
+
+	// every method gets its own branch so later routes
+	// for a single method don't leak into the others.
+	build := func() *branch {
+		b := createBranch()
+		branch := &b
+		parts := append([]string(nil), parts...)
+		var params []routeParam
+		for index := 0; len(parts) > 0; index++ {
+			name, pattern := paramName(parts[0])
+			if name != "" {
+				params = append(params, routeParam{name, index, pattern == "**"})
+				parts[0] = pattern
+			}
+			parts, branch = appendStage(parts, branch)
+		}
+		branch.handler = handler
+		branch.stream = stream
+		branch.handoff = len(middleware) > 0
+		branch.params = params
+		return &b
 	}
-	branch.handler = handler
 
 	if methodGuard != MethodUnkown {
-		router[methodGuard] = *mergeBranch(&router[methodGuard], &b)
+		mergeBranch(&router[methodGuard], build())
 	} else {
 		for i := 0; i < methodCount; i++ {
-			router[i] = *mergeBranch(&router[i], &b)
+			mergeBranch(&router[i], build())
 		}
 	}
 }
@@ -0,0 +1,190 @@
+package ghttp
+
+import (
+	"testing"
+)
+
+func routeRequest(t *testing.T, router *Router, raw string) Request {
+	req := parsedRequest(t, raw)
+	req.route, req.rest = router.findRoute(req.parser.method, req.parser.path)
+	return req
+}
+
+func TestRouterNamedParams(t *testing.T) {
+	router := NewRouter()
+	handler := func(req Request, res *Response) error { return nil }
+	router.Register("@GET/users/{id:#}", handler)
+	router.Register("@GET/users/{id:#}/posts/{slug}", handler)
+	router.Register("@GET/{kind:[a|b]}/{name:*}", handler)
+
+	req := routeRequest(t, router, "GET /users/42 HTTP/1.1\r\n\r\n")
+	assert(t, req.route != nil)
+	assert(t, req.ParamInt("id") == 42)
+
+	req = routeRequest(t, router, "GET /users/7/posts/hello-world HTTP/1.1\r\n\r\n")
+	assert(t, req.route != nil)
+	assert(t, req.ParamInt("id") == 7)
+	assert(t, string(req.Param("slug")) == "hello-world")
+	assert(t, len(req.Param("missing")) == 0)
+
+	req = routeRequest(t, router, "GET /b/test HTTP/1.1\r\n\r\n")
+	assert(t, req.route != nil)
+	assert(t, string(req.Param("kind")) == "b")
+	assert(t, string(req.Param("name")) == "test")
+
+	req = routeRequest(t, router, "GET /users/abc HTTP/1.1\r\n\r\n")
+	assert(t, req.route == nil)
+
+	path := []byte("/users/7/posts/hello-world")
+	allocs := testing.AllocsPerRun(100, func() {
+		req.route, req.rest = router.findRoute(MethodGet, path)
+		req.Param("slug")
+	})
+	assert(t, allocs == 0)
+}
+
+func TestRouterKeepsParentHandler(t *testing.T) {
+	router := NewRouter()
+	router.Register("@GET/a", func(req Request, res *Response) error { return nil })
+	router.Register("@GET/a/b", func(req Request, res *Response) error { return nil })
+
+	route, _ := router.findRoute(MethodGet, []byte("/a"))
+	assert(t, route != nil)
+	route, _ = router.findRoute(MethodGet, []byte("/a/b"))
+	assert(t, route != nil)
+}
+
+func TestRouterCatchAll(t *testing.T) {
+	router := NewRouter()
+	handler := func(req Request, res *Response) error { return nil }
+	router.Register("@GET/static/**", handler)
+	router.Register("@GET/static/css/#", handler)
+	router.Register("@GET/files/{file:**}", handler)
+
+	req := routeRequest(t, router, "GET /static/css/main.css HTTP/1.1\r\n\r\n")
+	assert(t, req.route != nil)
+	assert(t, string(req.PathRest()) == "css/main.css")
+
+	req = routeRequest(t, router, "GET /static/css/1 HTTP/1.1\r\n\r\n")
+	assert(t, req.route != nil && req.route.pattern == "#")
+	assert(t, len(req.PathRest()) == 0)
+
+	req = routeRequest(t, router, "GET /static HTTP/1.1\r\n\r\n")
+	assert(t, req.route != nil)
+	assert(t, len(req.PathRest()) == 0)
+
+	req = routeRequest(t, router, "GET /files/a/b/c.txt HTTP/1.1\r\n\r\n")
+	assert(t, string(req.Param("file")) == "a/b/c.txt")
+
+	req = routeRequest(t, router, "GET /other/a HTTP/1.1\r\n\r\n")
+	assert(t, req.route == nil)
+}
+
+func TestRouterMiddleware(t *testing.T) {
+	router := NewRouter()
+	trace := ""
+	tracing := func(name string) MiddlewareFunc {
+		return func(next HandlerFunc) HandlerFunc {
+			return func(req Request, res *Response) error {
+				trace += name + ">"
+				err := next(req, res)
+				trace += "<" + name
+				return err
+			}
+		}
+	}
+	router.Use(tracing("a"), tracing("b"))
+	router.Register("@GET/", func(req Request, res *Response) error {
+		trace += "handler"
+		return nil
+	})
+	admin := router.Group("/admin")
+	admin.Use(func(next HandlerFunc) HandlerFunc {
+		return func(req Request, res *Response) error {
+			trace += "denied"
+			return nil
+		}
+	})
+	admin.Register("@GET/", func(req Request, res *Response) error {
+		trace += "handler"
+		return nil
+	})
+
+	route, _ := router.findRoute(MethodGet, []byte("/"))
+	noError(t, route.handler(Request{}, nil))
+	assert(t, trace == "a>b>handler<b<a")
+
+	trace = ""
+	route, _ = router.findRoute(MethodGet, []byte("/admin"))
+	noError(t, route.handler(Request{}, nil))
+	assert(t, trace == "a>b>denied<b<a")
+
+	// the routes would miss the middleware.
+	for _, r := range []*Router{router, admin} {
+		func() {
+			defer func() {
+				assert(t, recover() != nil)
+			}()
+			r.Use(tracing("late"))
+		}()
+	}
+	router.Group("/other").Use(tracing("group"))
+}
+
+func TestRouterGroup(t *testing.T) {
+	router := NewRouter()
+	trace := ""
+	tracing := func(name string) MiddlewareFunc {
+		return func(next HandlerFunc) HandlerFunc {
+			return func(req Request, res *Response) error {
+				trace += name
+				return next(req, res)
+			}
+		}
+	}
+	handler := func(req Request, res *Response) error { return nil }
+	router.Use(tracing("root"))
+	api := router.Group("/api/v1/")
+	api.Use(tracing("api"))
+	api.Register("/users/{id:#}", handler)
+	admin := api.Group("@POST/admin")
+	admin.Use(tracing("admin"))
+	admin.Register("/", handler)
+	admin.Register("reset", handler)
+
+	req := routeRequest(t, router, "GET /api/v1/users/5 HTTP/1.1\r\n\r\n")
+	assert(t, req.route != nil)
+	assert(t, req.ParamInt("id") == 5)
+	noError(t, req.route.handler(req, nil))
+	assert(t, trace == "rootapi")
+
+	route, _ := router.findRoute(MethodPost, []byte("/api/v1/admin/reset"))
+	assert(t, route != nil)
+	trace = ""
+	noError(t, route.handler(req, nil))
+	assert(t, trace == "rootapiadmin")
+
+	route, _ = router.findRoute(MethodPost, []byte("/api/v1/admin"))
+	assert(t, route != nil)
+	route, _ = router.findRoute(MethodGet, []byte("/api/v1/admin/reset"))
+	assert(t, route == nil)
+
+	defer func() {
+		assert(t, recover() != nil)
+	}()
+	admin.Register("@GET/x", handler)
+}
+
+func TestRouterMethodsDontLeak(t *testing.T) {
+	router := NewRouter()
+	handler := func(req Request, res *Response) error { return nil }
+	router.Register("/a", handler)
+	router.Register("@GET/a/b", handler)
+
+	route, _ := router.findRoute(MethodPost, []byte("/a"))
+	assert(t, route != nil)
+	route, _ = router.findRoute(MethodPost, []byte("/a/b"))
+	assert(t, route == nil)
+	route, _ = router.findRoute(MethodGet, []byte("/a/b"))
+	assert(t, route != nil)
+}
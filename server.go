@@ -0,0 +1,333 @@
+package ghttp
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/panjf2000/gnet/v2"
+	"github.com/panjf2000/gnet/v2/pkg/logging"
+)
+
+// ServerOptions configure a Server.
+type ServerOptions struct {
+	// Multicore runs an event loop per CPU core.
+	Multicore bool
+	// NumEventLoop sets the number of event loops,
+	// it overrides Multicore if set.
+	NumEventLoop int
+	// ReadBufferCap is the maximum number of bytes read
+	// from a connection at once.
+	ReadBufferCap int
+	// TCPKeepAlive enables TCP keep-alive with the period if set.
+	TCPKeepAlive time.Duration
+	// ReusePort sets SO_REUSEPORT on the listener.
+	ReusePort bool
+	// ProxyProtocol requires a PROXY protocol v1 or v2 header at the start
+	// of every connection, as sent by HAProxy or AWS NLB. Connections
+	// without it are closed. The client it names is Request.ClientAddr.
+	ProxyProtocol bool
+	// TrustedProxies are the networks of proxies whose forwarding
+	// headers are honored by Request.RealIP.
+	TrustedProxies []netip.Prefix
+	// TLSConfig enables TLS termination. The certificate is selected by
+	// the server name (SNI) of the client from its Certificates or by
+	// GetCertificate. Without NextProtos http/1.1 and, if enabled,
+	// h2 are announced with ALPN. The handshake has to finish within
+	// ReadHeaderTimeout, or 10 seconds without it.
+	TLSConfig *tls.Config
+	// MaxTLSHandshakes is the maximum number of TLS handshakes running
+	// at once, new connections beyond it are closed.
+	MaxTLSHandshakes int
+	// HTTP2 enables HTTP/2 over cleartext (h2c) for clients with prior
+	// knowledge and requests with "Upgrade: h2c". Request bodies of
+	// HTTP/2 streams are always read completely, also for stream routes.
+	HTTP2 bool
+	// Logger is used by the server and gnet,
+	// the default logger of gnet is used if nil.
+	Logger logging.Logger
+	// IdleTimeout closes keep-alive connections without
+	// a request for this duration if set.
+	IdleTimeout time.Duration
+	// ReadHeaderTimeout is the time allowed to read a request header,
+	// slower requests are answered with 408 Request Timeout.
+	ReadHeaderTimeout time.Duration
+	// ReadBodyTimeout is the time allowed to read a request body,
+	// slower requests are answered with 408 Request Timeout
+	// or closed if the body is streamed.
+	ReadBodyTimeout time.Duration
+	// WriteTimeout closes connections which don't receive
+	// a response within this duration.
+	WriteTimeout time.Duration
+	// MaxURILength is the maximum length of the request target,
+	// longer requests are answered with 414 URI Too Long.
+	MaxURILength int
+	// MaxHeaderSize is the maximum size of the request line and header,
+	// larger requests are answered with 431 Request Header Fields Too Large.
+	MaxHeaderSize int
+	// MaxHeaderCount is the maximum number of request header fields,
+	// more are answered with 431 Request Header Fields Too Large.
+	MaxHeaderCount int
+	// MaxBodySize is the maximum size of a request body which is read into
+	// memory, larger bodies are answered with 413 Content Too Large.
+	// It limits the size of WebSocket messages too.
+	MaxBodySize int
+	// MaxStreamBodySize is the maximum size of a request body of a stream
+	// route. Larger bodies with a Content-Length are answered with 413
+	// Content Too Large, chunked ones fail the read once the limit is passed.
+	MaxStreamBodySize int
+	// OnReject is called for every request which is rejected
+	// with an error response before it is routed if set.
+	OnReject RejectHandlerFunc
+}
+
+// Default limits of a Server, they are
+// used for zero limits. Negative limits are unlimited.
+const (
+	DefaultMaxURILength      = 8 << 10
+	DefaultMaxHeaderSize     = 1 << 20
+	DefaultMaxHeaderCount    = 100
+	DefaultMaxBodySize       = 32 << 20
+	DefaultMaxStreamBodySize = 1 << 30
+	DefaultMaxTLSHandshakes  = 1024
+)
+
+// Server is an http server running the routes of a Router.
+type Server struct {
+	router  *Router
+	options ServerOptions
+	tls     *tls.Config
+
+	mu sync.Mutex
+	// engines are the running listeners, once stopped
+	// listeners which start later are shut down.
+	engines []gnet.Engine
+	stopped bool
+	closing atomic.Bool
+	// blocking counts the running blocking handlers
+	// and writes their pending responses.
+	blocking atomic.Int64
+	writes   atomic.Int64
+	// handshakes counts the running TLS handshakes.
+	handshakes atomic.Int64
+}
+
+// ErrNoAddress is returned by ListenAndServe without addresses.
+var ErrNoAddress = errors.New("no address to listen on")
+
+// shutdownPollInterval is how often Shutdown checks
+// for running blocking handlers.
+const shutdownPollInterval = 10 * time.Millisecond
+
+// NewServer creates a server for the router.
+func NewServer(router *Router, options ServerOptions) *Server {
+	if options.Logger == nil {
+		options.Logger = logging.GetDefaultLogger()
+	}
+	options.MaxURILength = limit(options.MaxURILength, DefaultMaxURILength)
+	options.MaxHeaderSize = limit(options.MaxHeaderSize, DefaultMaxHeaderSize)
+	options.MaxHeaderCount = limit(options.MaxHeaderCount, DefaultMaxHeaderCount)
+	options.MaxBodySize = limit(options.MaxBodySize, DefaultMaxBodySize)
+	options.MaxStreamBodySize = limit(options.MaxStreamBodySize, DefaultMaxStreamBodySize)
+	options.MaxTLSHandshakes = limit(options.MaxTLSHandshakes, DefaultMaxTLSHandshakes)
+	return &Server{router: router.root(), options: options}
+}
+
+// limit returns the default for a zero limit
+// and zero, unlimited, for a negative one.
+func limit(value, def int) int {
+	if value == 0 {
+		return def
+	}
+	if value < 0 {
+		return 0
+	}
+	return value
+}
+
+func (s *Server) parserLimits() parserLimits {
+	return parserLimits{
+		maxURILength:   s.options.MaxURILength,
+		maxHeaderSize:  s.options.MaxHeaderSize,
+		maxHeaderCount: s.options.MaxHeaderCount,
+	}
+}
+
+// ListenAndServe listens as an http server on the given addresses, like
+// "tcp://:8080" or "unix:///tmp/ghttp.sock", which share the router.
+// This will block until an error occurs or the server is shut down.
+// If a listener fails the others are stopped.
+//
+// gnet lowercases the addresses, so paths of unix sockets must be lowercase.
+func (s *Server) ListenAndServe(addresses ...string) error {
+	if len(addresses) == 0 {
+		return ErrNoAddress
+	}
+	if s.options.TLSConfig != nil {
+		s.tls = s.tlsConfig()
+	}
+	errs := make(chan error, len(addresses))
+	for _, address := range addresses {
+		go func(address string) {
+			http := &httpServer{server: s, router: s.router}
+			errs <- gnet.Run(http, address, s.gnetOptions()...)
+		}(address)
+	}
+	var err error
+	for range addresses {
+		if runErr := <-errs; runErr != nil && err == nil {
+			err = runErr
+			s.stop(context.Background())
+		}
+	}
+	return err
+}
+
+func (s *Server) gnetOptions() []gnet.Option {
+	options := []gnet.Option{
+		gnet.WithMulticore(s.options.Multicore),
+		gnet.WithReusePort(s.options.ReusePort),
+		gnet.WithLogger(s.options.Logger),
+	}
+	if s.options.NumEventLoop > 0 {
+		options = append(options, gnet.WithNumEventLoop(s.options.NumEventLoop))
+	}
+	if s.options.ReadBufferCap > 0 {
+		options = append(options, gnet.WithReadBufferCap(s.options.ReadBufferCap))
+	}
+	if s.options.TCPKeepAlive > 0 {
+		options = append(options, gnet.WithTCPKeepAlive(s.options.TCPKeepAlive))
+	}
+	if s.hasTimeouts() {
+		options = append(options, gnet.WithTicker(true))
+	}
+	return options
+}
+
+// hasTimeouts reports whether connections are checked for timeouts.
+func (s *Server) hasTimeouts() bool {
+	return s.options.IdleTimeout > 0 || s.options.ReadHeaderTimeout > 0 ||
+		s.options.ReadBodyTimeout > 0 || s.options.WriteTimeout > 0
+}
+
+// timeout is the timeout of a connection phase, zero if it has none.
+func (s *Server) timeout(p phase) time.Duration {
+	switch p {
+	case phaseIdle:
+		return s.options.IdleTimeout
+	case phaseHeader:
+		return s.options.ReadHeaderTimeout
+	case phaseBody:
+		return s.options.ReadBodyTimeout
+	case phaseWrite:
+		return s.options.WriteTimeout
+	}
+	return 0
+}
+
+// tickInterval is the precision of the timeouts.
+func (s *Server) tickInterval() time.Duration {
+	interval := time.Second
+	for p := phaseIdle; p <= phaseWrite; p++ {
+		if timeout := s.timeout(p) / 4; timeout > 0 && timeout < interval {
+			interval = timeout
+		}
+	}
+	if interval < 10*time.Millisecond {
+		interval = 10 * time.Millisecond
+	}
+	return interval
+}
+
+// boot registers the engine of a listener,
+// it reports whether the server is stopped already.
+func (s *Server) boot(eng gnet.Engine) (stopped bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stopped {
+		return true
+	}
+	s.engines = append(s.engines, eng)
+	if s.closing.Load() {
+		s.stopAccepting(eng)
+	}
+	return false
+}
+
+// stopAccepting stops the listener of the engine, connections which
+// were accepted already are closed by OnOpen.
+func (s *Server) stopAccepting(eng gnet.Engine) {
+	if err := stopAccepting(eng); err != nil {
+		s.options.Logger.Warnf("ghttp: failed to stop accepting connections: %v", err)
+	}
+}
+
+// stop stops all listeners.
+func (s *Server) stop(ctx context.Context) (err error) {
+	s.mu.Lock()
+	engines := s.engines
+	s.engines = nil
+	s.stopped = true
+	s.mu.Unlock()
+	for _, engine := range engines {
+		if stopErr := engine.Stop(ctx); err == nil {
+			err = stopErr
+		}
+	}
+	return err
+}
+
+// Shutdown gracefully shuts down the server.
+// It stops accepting connections, waits for running blocking handlers
+// and the writes of their responses and then stops the server.
+// If ctx expires first its error is returned and the server is stopped.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.closing.Store(true)
+	for _, engine := range s.engines {
+		s.stopAccepting(engine)
+	}
+	s.mu.Unlock()
+	var err error
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for err == nil && (s.blocking.Load() > 0 || s.writes.Load() > 0) {
+		select {
+		case <-ctx.Done():
+			err = ctx.Err()
+			ctx = context.Background()
+		case <-ticker.C:
+		}
+	}
+	if stopErr := s.stop(ctx); err == nil {
+		err = stopErr
+	}
+	return err
+}
+
+// asyncWrite writes the response of a blocking handler.
+// The write is tracked until it is done or the connection closed.
+// The callback is not called if the connection is closed.
+func (s *Server) asyncWrite(c gnet.Conn, hc *httpCodec, data []byte, callback gnet.AsyncCallback) error {
+	hc.mu.Lock()
+	if hc.closed {
+		hc.mu.Unlock()
+		return net.ErrClosed
+	}
+	hc.pending++
+	s.writes.Add(1)
+	hc.mu.Unlock()
+	err := c.AsyncWrite(data, func(c gnet.Conn, err error) error {
+		hc.writeDone()
+		return callback(c, err)
+	})
+	if err != nil {
+		hc.writeDone()
+	}
+	return err
+}
@@ -0,0 +1,105 @@
+package ghttp
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Event is a server-sent event.
+// Empty fields aren't sent.
+type Event struct {
+	ID    string
+	Event string
+	Data  string
+	// Retry tells the client how long to wait
+	// before reconnecting.
+	Retry time.Duration
+}
+
+// EventStream sends server-sent events to a client.
+type EventStream struct {
+	req    Request
+	res    *Response
+	closed <-chan struct{}
+}
+
+// EventHandlerFunc handles a server-sent event stream,
+// the stream ends when it returns.
+type EventHandlerFunc = func(req Request, events *EventStream) error
+
+// HandleEvents answers the request with a stream of server-sent events.
+// Like HandleBlocking fn runs outside of the I/O loop and may block.
+// The header is sent before fn is called.
+func (r Request) HandleEvents(fn EventHandlerFunc) {
+	r.HandleBlocking(func(req Request, res *Response) error {
+		res.AddHeader([2]string{"Content-Type", "text/event-stream"})
+		res.AddHeader([2]string{"Cache-Control", "no-cache"})
+		if err := res.Flush(); err != nil {
+			return err
+		}
+		events := &EventStream{req: req, res: res, closed: req.codec.closeNotify()}
+		return fn(req, events)
+	})
+}
+
+// LastEventID returns the Last-Event-ID header sent by a
+// reconnecting client, it is empty for new clients.
+func (s *EventStream) LastEventID() string {
+	return s.req.Header("Last-Event-ID")
+}
+
+// Send sends the event to the client. It returns an error
+// if the client disconnected.
+func (s *EventStream) Send(event Event) error {
+	if event.ID != "" {
+		s.writeField("id", event.ID)
+	}
+	if event.Event != "" {
+		s.writeField("event", event.Event)
+	}
+	if event.Retry > 0 {
+		s.writeField("retry", strconv.FormatInt(event.Retry.Milliseconds(), 10))
+	}
+	data := event.Data
+	for {
+		line, rest, found := strings.Cut(data, "\n")
+		s.writeField("data", strings.TrimSuffix(line, "\r"))
+		if !found {
+			break
+		}
+		data = rest
+	}
+	s.res.WriteString("\n")
+	return s.res.Flush()
+}
+
+// Comment sends a comment ignored by the client,
+// it can be used to keep the connection alive.
+func (s *EventStream) Comment(comment string) error {
+	s.res.WriteString(": ")
+	s.res.WriteString(stripNewlines(comment))
+	s.res.WriteString("\n\n")
+	return s.res.Flush()
+}
+
+// Done returns a channel which is closed
+// when the client disconnects.
+func (s *EventStream) Done() <-chan struct{} {
+	return s.closed
+}
+
+func (s *EventStream) writeField(name, value string) {
+	s.res.WriteString(name)
+	s.res.WriteString(": ")
+	s.res.WriteString(stripNewlines(value))
+	s.res.WriteString("\n")
+}
+
+// stripNewlines removes line breaks which would end a field.
+func stripNewlines(s string) string {
+	if !strings.ContainsAny(s, "\r\n") {
+		return s
+	}
+	return strings.NewReplacer("\r", "", "\n", "").Replace(s)
+}
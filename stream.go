@@ -0,0 +1,183 @@
+package ghttp
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/panjf2000/gnet/v2"
+)
+
+// ErrNotBlocking is returned when a response is flushed
+// outside of a blocking handler.
+var ErrNotBlocking = errors.New("response is not handled by a blocking handler")
+
+const (
+	// streamHighWater is the number of bytes buffered in the connection
+	// above which Flush waits for the client to catch up.
+	streamHighWater = 256 << 10
+	// streamPollInterval is how often Flush checks
+	// the buffered bytes of the connection.
+	streamPollInterval = 5 * time.Millisecond
+)
+
+// responseStream sends the response of a blocking handler
+// in parts as it is flushed.
+type responseStream struct {
+	conn  gnet.Conn
+	codec *httpCodec
+	// h2 is the stream of HTTP/2 requests.
+	h2 *h2Stream
+	// started is set once the header has been sent.
+	started bool
+	// raw is set if the body isn't chunked because its
+	// length is known or the client speaks HTTP/1.0.
+	raw  bool
+	err  error
+	done chan streamWrite
+}
+
+// streamWrite is the result of a write of a stream.
+type streamWrite struct {
+	err      error
+	buffered int
+}
+
+func newResponseStream(conn gnet.Conn, codec *httpCodec) *responseStream {
+	return &responseStream{conn: conn, codec: codec, done: make(chan streamWrite, 1)}
+}
+
+// Flush sends the body written so far to the client and resets it.
+// The header is sent with the first Flush and can't be changed
+// afterwards. The body is chunked unless a Content-Length header is set,
+// HTTP/1.0 clients are sent the body until the connection closes.
+//
+// Flush may only be used by blocking handlers, it returns ErrNotBlocking
+// otherwise. It blocks until the data is handed to the connection and
+// the client has caught up with previous data. An error is returned if
+// the client disconnected.
+func (r *Response) Flush() error {
+	stream := r.stream
+	if stream == nil {
+		return ErrNotBlocking
+	}
+	if stream.err != nil {
+		return stream.err
+	}
+	if stream.h2 != nil {
+		stream.err = r.flushH2()
+		return stream.err
+	}
+	buf := bytePool.Get().(*bytes.Buffer)
+	r.renderPart(buf)
+	stream.err = stream.write(buf, nil)
+	return stream.err
+}
+
+// renderPart renders the header if it hasn't been sent
+// and the body written since the last part.
+func (r *Response) renderPart(into *bytes.Buffer) {
+	stream := r.stream
+	if !stream.started {
+		stream.started = true
+		stream.raw = r.http10 || r.hasHeader("Content-Length")
+		if r.http10 && !r.hasHeader("Content-Length") {
+			// the end of the body is signaled by closing.
+			r.close = true
+		}
+		r.renderStatus(into)
+		if !stream.raw {
+			r.renderTrailerHeader(into)
+			into.WriteString("Transfer-Encoding: chunked\r\n")
+		}
+		into.WriteString("\r\n")
+	}
+	if stream.raw {
+		into.Write(r.body.Bytes())
+	} else {
+		writeChunk(into, r.body.Bytes())
+	}
+	r.body.Reset()
+}
+
+func (r *Response) hasHeader(name string) bool {
+	for _, header := range r.headers {
+		if strings.EqualFold(header[0], name) {
+			return true
+		}
+	}
+	return false
+}
+
+// write writes buf to the connection and waits until
+// the client caught up. If set onLoop is called on the event loop
+// with every write and returns the bytes it holds back.
+func (s *responseStream) write(buf *bytes.Buffer, onLoop func() int) error {
+	closed := s.codec.closeNotify()
+	for {
+		err := s.codec.server.asyncWrite(s.conn, s.codec, buf.Bytes(), func(c gnet.Conn, err error) error {
+			buffered := c.OutboundBuffered()
+			if onLoop != nil {
+				buffered += onLoop()
+			}
+			s.done <- streamWrite{err: err, buffered: buffered}
+			return nil
+		})
+		if err != nil {
+			buf.Reset()
+			bytePool.Put(buf)
+			return err
+		}
+		var result streamWrite
+		select {
+		case result = <-s.done:
+		case <-closed:
+			// the callback won't be called, buf may still be referenced.
+			return net.ErrClosed
+		}
+		if buf.Len() > 0 {
+			buf.Reset()
+			bytePool.Put(buf)
+		}
+		if result.err != nil || result.buffered <= streamHighWater {
+			return result.err
+		}
+		// poll the buffered bytes with an empty write.
+		time.Sleep(streamPollInterval)
+		buf = &bytes.Buffer{}
+	}
+}
+
+// finish sends the rest of the streamed response. If the handler
+// failed after the header was sent the connection is closed as
+// the response can't be answered with an error anymore.
+func (r *Response) finish(err error) {
+	stream := r.stream
+	if stream.h2 != nil {
+		r.finishH2(err)
+		return
+	}
+	if err != nil || stream.err != nil {
+		stream.conn.Close()
+		returnResponse(r)
+		return
+	}
+	buf := bytePool.Get().(*bytes.Buffer)
+	r.renderPart(buf)
+	if !stream.raw {
+		writeLastChunk(buf, r.trailers)
+	}
+	closing := r.close
+	stream.codec.server.asyncWrite(stream.conn, stream.codec, buf.Bytes(), func(c gnet.Conn, err error) error {
+		buf.Reset()
+		bytePool.Put(buf)
+		returnResponse(r)
+		if closing {
+			stream.codec.closing = true
+		}
+		resume(c)
+		return nil
+	})
+}
@@ -17,11 +17,12 @@ func dateMiddleware(handler ghttp.HandlerFunc) ghttp.HandlerFunc {
 
 func main() {
 	router := ghttp.NewRouter()
+	router.Use(dateMiddleware)
 	router.Register("@GET/1sec", func(req ghttp.Request, res *ghttp.Response) error {
-		req.HandleBlocking(dateMiddleware(func(r ghttp.Request, res *ghttp.Response) error {
+		req.HandleBlocking(func(r ghttp.Request, res *ghttp.Response) error {
 			time.Sleep(time.Second)
 			return nil
-		}))
+		})
 		return nil
 	})
 	router.Register("@GET/#", func(req ghttp.Request, res *ghttp.Response) error {
@@ -0,0 +1,341 @@
+package ghttp
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/panjf2000/gnet/v2"
+)
+
+// tlsConn is the TLS layer in front of the httpCodec. It implements
+// gnet.Conn over the plaintext of the connection, writes are encrypted
+// and reads return the decrypted records.
+//
+// crypto/tls can't resume a handshake which ran out of data, so the
+// handshake runs in its own goroutine fed by OnTraffic. It is bounded
+// by a timeout and ServerOptions.MaxTLSHandshakes. Once it is done
+// records are decrypted on the event loop without blocking.
+type tlsConn struct {
+	gnet.Conn
+	tls       *tls.Conn
+	transport *tlsTransport
+	// ready is set once the handshake is done.
+	ready bool
+	plain []byte
+}
+
+// errWouldBlock is returned by tlsTransport if it has no data,
+// crypto/tls keeps partial records and retries on temporary errors.
+var errWouldBlock net.Error = wouldBlock{}
+
+type wouldBlock struct{}
+
+func (wouldBlock) Error() string   { return "tls: would block" }
+func (wouldBlock) Timeout() bool   { return true }
+func (wouldBlock) Temporary() bool { return true }
+
+// tlsTransport is the net.Conn under tls.Conn carrying the encrypted data.
+type tlsTransport struct {
+	raw  gnet.Conn
+	mu   sync.Mutex
+	cond *sync.Cond
+	in   []byte
+	// blocking is set during the handshake, reads wait
+	// for data and writes are asynchronous.
+	blocking bool
+	closed   bool
+}
+
+func newTLSConn(c gnet.Conn, config *tls.Config) *tlsConn {
+	transport := &tlsTransport{raw: c, blocking: true}
+	transport.cond = sync.NewCond(&transport.mu)
+	return &tlsConn{Conn: c, tls: tls.Server(transport, config), transport: transport}
+}
+
+// handshake runs the TLS handshake which fails after timeout,
+// the connection is woken up or closed once it is done.
+func (t *tlsConn) handshake(timeout time.Duration, done func()) {
+	// releases the handshake waiting for data.
+	timer := time.AfterFunc(timeout, func() { t.transport.Close() })
+	err := t.tls.Handshake()
+	timer.Stop()
+	done()
+	t.Conn.AsyncWrite(nil, func(c gnet.Conn, _ error) error {
+		if err != nil {
+			return c.Close()
+		}
+		t.transport.mu.Lock()
+		t.transport.blocking = false
+		t.transport.mu.Unlock()
+		t.ready = true
+		return c.Wake(nil)
+	})
+}
+
+// onTraffic hands the received data to the TLS layer and
+// decrypts it if the handshake is done.
+func (t *tlsConn) onTraffic() gnet.Action {
+	data, _ := t.Conn.Next(-1)
+	if len(data) > 0 {
+		t.transport.feed(data)
+	}
+	if !t.ready {
+		return gnet.None
+	}
+	for {
+		if cap(t.plain)-len(t.plain) < tlsReadSize {
+			plain := make([]byte, len(t.plain), 2*cap(t.plain)+tlsReadSize)
+			copy(plain, t.plain)
+			t.plain = plain
+		}
+		n, err := t.tls.Read(t.plain[len(t.plain):cap(t.plain)])
+		t.plain = t.plain[:len(t.plain)+n]
+		if err == errWouldBlock {
+			return gnet.None
+		}
+		if err != nil {
+			// the client closed the connection or sent an invalid record.
+			return gnet.Close
+		}
+	}
+}
+
+// tlsReadSize is the space for at least one decrypted record.
+const tlsReadSize = 16 << 10
+
+func (t *tlsConn) close() {
+	t.transport.Close()
+}
+
+func (t *tlsConn) Read(p []byte) (int, error) {
+	if len(t.plain) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, t.plain)
+	t.Discard(n)
+	return n, nil
+}
+
+func (t *tlsConn) WriteTo(w io.Writer) (int64, error) {
+	n, err := w.Write(t.plain)
+	t.Discard(n)
+	return int64(n), err
+}
+
+func (t *tlsConn) Next(n int) ([]byte, error) {
+	buf, err := t.Peek(n)
+	if err != nil {
+		return nil, err
+	}
+	// the data stays valid until the next read.
+	buf = CopyBytes(buf)
+	t.Discard(len(buf))
+	return buf, nil
+}
+
+func (t *tlsConn) Peek(n int) ([]byte, error) {
+	if n < 0 || n == len(t.plain) {
+		return t.plain, nil
+	}
+	if n > len(t.plain) {
+		return t.plain, io.ErrShortBuffer
+	}
+	return t.plain[:n], nil
+}
+
+func (t *tlsConn) Discard(n int) (int, error) {
+	if n < 0 || n > len(t.plain) {
+		n = len(t.plain)
+	}
+	t.plain = t.plain[:copy(t.plain, t.plain[n:])]
+	return n, nil
+}
+
+// InboundBuffered includes partial records which aren't decrypted yet.
+func (t *tlsConn) InboundBuffered() int {
+	return len(t.plain) + t.transport.buffered()
+}
+
+func (t *tlsConn) Write(p []byte) (int, error) {
+	return t.tls.Write(p)
+}
+
+func (t *tlsConn) ReadFrom(r io.Reader) (int64, error) {
+	data, err := io.ReadAll(r)
+	n, werr := t.Write(data)
+	if err == nil {
+		err = werr
+	}
+	return int64(n), err
+}
+
+func (t *tlsConn) Writev(bs [][]byte) (int, error) {
+	written := 0
+	for _, b := range bs {
+		n, err := t.Write(b)
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+func (t *tlsConn) AsyncWrite(buf []byte, callback gnet.AsyncCallback) error {
+	return t.Conn.AsyncWrite(nil, func(c gnet.Conn, err error) error {
+		if err == nil && len(buf) > 0 {
+			_, err = t.Write(buf)
+		}
+		if callback != nil {
+			return callback(t, err)
+		}
+		return nil
+	})
+}
+
+func (t *tlsConn) AsyncWritev(bs [][]byte, callback gnet.AsyncCallback) error {
+	return t.Conn.AsyncWrite(nil, func(c gnet.Conn, err error) error {
+		if err == nil {
+			_, err = t.Writev(bs)
+		}
+		if callback != nil {
+			return callback(t, err)
+		}
+		return nil
+	})
+}
+
+func (t *tlsConn) Wake(callback gnet.AsyncCallback) error {
+	if callback == nil {
+		return t.Conn.Wake(nil)
+	}
+	return t.Conn.Wake(func(c gnet.Conn, err error) error {
+		return callback(t, err)
+	})
+}
+
+func (t *tlsConn) CloseWithCallback(callback gnet.AsyncCallback) error {
+	if callback == nil {
+		return t.Conn.CloseWithCallback(nil)
+	}
+	return t.Conn.CloseWithCallback(func(c gnet.Conn, err error) error {
+		return callback(t, err)
+	})
+}
+
+// feed adds received data for the TLS layer.
+func (t *tlsTransport) feed(data []byte) {
+	t.mu.Lock()
+	t.in = append(t.in, data...)
+	t.mu.Unlock()
+	t.cond.Signal()
+}
+
+func (t *tlsTransport) buffered() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.in)
+}
+
+func (t *tlsTransport) Read(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for t.blocking && len(t.in) == 0 && !t.closed {
+		t.cond.Wait()
+	}
+	if t.closed {
+		return 0, net.ErrClosed
+	}
+	if len(t.in) == 0 {
+		return 0, errWouldBlock
+	}
+	n := copy(p, t.in)
+	t.in = t.in[:copy(t.in, t.in[n:])]
+	return n, nil
+}
+
+func (t *tlsTransport) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	blocking := t.blocking
+	t.mu.Unlock()
+	if blocking {
+		// the handshake runs outside of the event loop.
+		return len(p), t.raw.AsyncWrite(CopyBytes(p), nil)
+	}
+	return t.raw.Write(p)
+}
+
+// Close releases a waiting handshake, the connection itself is
+// closed by gnet.
+func (t *tlsTransport) Close() error {
+	t.mu.Lock()
+	t.closed = true
+	t.mu.Unlock()
+	t.cond.Broadcast()
+	return nil
+}
+
+func (t *tlsTransport) LocalAddr() net.Addr              { return t.raw.LocalAddr() }
+func (t *tlsTransport) RemoteAddr() net.Addr             { return t.raw.RemoteAddr() }
+func (t *tlsTransport) SetDeadline(time.Time) error      { return nil }
+func (t *tlsTransport) SetReadDeadline(time.Time) error  { return nil }
+func (t *tlsTransport) SetWriteDeadline(time.Time) error { return nil }
+
+// tlsHandshakeTimeout bounds handshakes without ReadHeaderTimeout.
+const tlsHandshakeTimeout = 10 * time.Second
+
+// handshakeTimeout is the time allowed for a TLS handshake.
+func (s *Server) handshakeTimeout() time.Duration {
+	if s.options.ReadHeaderTimeout > 0 {
+		return s.options.ReadHeaderTimeout
+	}
+	return tlsHandshakeTimeout
+}
+
+// startHandshake reports whether another TLS handshake may run,
+// endHandshake has to be called once it is done.
+func (s *Server) startHandshake() bool {
+	max := int64(s.options.MaxTLSHandshakes)
+	if s.handshakes.Add(1) > max && max > 0 {
+		s.handshakes.Add(-1)
+		return false
+	}
+	return true
+}
+
+func (s *Server) endHandshake() {
+	s.handshakes.Add(-1)
+}
+
+// tlsConfig returns the TLS configuration of the server, the
+// protocols are announced with ALPN unless they are configured.
+func (s *Server) tlsConfig() *tls.Config {
+	config := s.options.TLSConfig.Clone()
+	if len(config.NextProtos) == 0 {
+		config.NextProtos = []string{"http/1.1"}
+		if s.options.HTTP2 {
+			config.NextProtos = []string{"h2", "http/1.1"}
+		}
+	}
+	return config
+}
+
+// ListenAndServeTLS listens as an https server on the given address with
+// the certificate and key of the PEM files. They are added to the
+// certificates of ServerOptions.TLSConfig.
+func (s *Server) ListenAndServeTLS(address, certFile, keyFile string) error {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+	config := &tls.Config{}
+	if s.options.TLSConfig != nil {
+		config = s.options.TLSConfig.Clone()
+	}
+	config.Certificates = append(config.Certificates, cert)
+	s.options.TLSConfig = config
+	return s.ListenAndServe(address)
+}
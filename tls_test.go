@@ -0,0 +1,202 @@
+package ghttp
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// generateCert creates a self-signed certificate for the names
+// and returns it with its PEM encoded certificate and key.
+func generateCert(t *testing.T, names ...string) (tls.Certificate, []byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	noError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: names[0]},
+		DNSNames:     names,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	noError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	noError(t, err)
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	noError(t, err)
+	return cert, certPEM, keyPEM
+}
+
+func dialTLS(t *testing.T, address, serverName string, protos ...string) *tls.Conn {
+	conn, err := tls.Dial("tcp", address, &tls.Config{
+		ServerName:         serverName,
+		NextProtos:         protos,
+		InsecureSkipVerify: true,
+	})
+	noError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	return conn
+}
+
+func TestTLS(t *testing.T) {
+	example, _, _ := generateCert(t, "example.com")
+	other, _, _ := generateCert(t, "other.test")
+	router := h2TestRouter()
+	address := startServer(t, NewServer(router, ServerOptions{
+		TLSConfig: &tls.Config{Certificates: []tls.Certificate{example, other}},
+	}))
+
+	conn := dialTLS(t, address, "other.test", "http/1.1")
+	state := conn.ConnectionState()
+	assert(t, state.NegotiatedProtocol == "http/1.1")
+	assert(t, state.PeerCertificates[0].Subject.CommonName == "other.test")
+	_, err := conn.Write([]byte("GET /hello/a HTTP/1.1\r\nHost: a\r\n\r\nGET /blocking HTTP/1.1\r\nX-Test: tls\r\n\r\nGET /large HTTP/1.1\r\n\r\n"))
+	noError(t, err)
+	reader := bufio.NewReader(conn)
+	_, body := readResponse(t, reader)
+	assert(t, body == "hello a")
+	_, body = readResponse(t, reader)
+	assert(t, body == "blocking tls")
+	_, body = readResponse(t, reader)
+	assert(t, body == strings.Repeat("x", 100))
+
+	// the first certificate is the default without SNI.
+	conn = dialTLS(t, address, "", "http/1.1")
+	assert(t, conn.ConnectionState().PeerCertificates[0].Subject.CommonName == "example.com")
+
+	// plaintext requests fail the handshake.
+	raw, err := net.Dial("tcp", address)
+	noError(t, err)
+	defer raw.Close()
+	raw.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err = raw.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+	noError(t, err)
+	_, err = bufio.NewReader(raw).ReadString('\n')
+	assert(t, err != nil)
+}
+
+func TestTLSHandshakeLimits(t *testing.T) {
+	cert, _, _ := generateCert(t, "example.com")
+	server := NewServer(h2TestRouter(), ServerOptions{
+		TLSConfig:         &tls.Config{Certificates: []tls.Certificate{cert}},
+		ReadHeaderTimeout: 200 * time.Millisecond,
+		MaxTLSHandshakes:  1,
+	})
+	address := startServer(t, server)
+	// the connection of startServer ends its handshake.
+	time.Sleep(50 * time.Millisecond)
+	for server.handshakes.Load() != 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	stalled, err := net.Dial("tcp", address)
+	noError(t, err)
+	defer stalled.Close()
+	stalled.SetDeadline(time.Now().Add(5 * time.Second))
+	time.Sleep(50 * time.Millisecond)
+
+	// the second handshake is over the limit.
+	refused, err := net.Dial("tcp", address)
+	noError(t, err)
+	defer refused.Close()
+	refused.SetDeadline(time.Now().Add(100 * time.Millisecond))
+	_, err = refused.Read(make([]byte, 1))
+	assert(t, err == io.EOF)
+
+	// the stalled handshake times out and frees its slot.
+	start := time.Now()
+	_, err = stalled.Read(make([]byte, 1))
+	assert(t, err == io.EOF)
+	assert(t, time.Since(start) < 2*time.Second)
+	time.Sleep(50 * time.Millisecond)
+	conn := dialTLS(t, address, "example.com", "http/1.1")
+	_, err = conn.Write([]byte("GET /hello/a HTTP/1.1\r\nHost: a\r\n\r\n"))
+	noError(t, err)
+	_, body := readResponse(t, bufio.NewReader(conn))
+	assert(t, body == "hello a")
+}
+
+func TestTLSStreamingResponse(t *testing.T) {
+	cert, _, _ := generateCert(t, "example.com")
+	address := startServer(t, NewServer(h2TestRouter(), ServerOptions{
+		TLSConfig: &tls.Config{Certificates: []tls.Certificate{cert}},
+	}))
+	conn := dialTLS(t, address, "example.com")
+	_, err := conn.Write([]byte("GET /stream HTTP/1.1\r\nHost: a\r\n\r\n"))
+	noError(t, err)
+	res, body := readResponse(t, bufio.NewReader(conn))
+	assert(t, body == "abc")
+	assert(t, res.Trailer.Get("X-Done") == "yes")
+}
+
+func TestTLSALPN(t *testing.T) {
+	cert, _, _ := generateCert(t, "example.com")
+	address := startServer(t, NewServer(h2TestRouter(), ServerOptions{
+		HTTP2:     true,
+		TLSConfig: &tls.Config{Certificates: []tls.Certificate{cert}},
+	}))
+	conn := dialTLS(t, address, "example.com", "h2", "http/1.1")
+	assert(t, conn.ConnectionState().NegotiatedProtocol == "h2")
+
+	client := &h2Client{t: t, conn: conn, reader: bufio.NewReader(conn), decoder: newHpackDecoder(h2HeaderTableSize)}
+	_, err := conn.Write([]byte(http2Preface))
+	noError(t, err)
+	client.settings()
+	client.request(1, "", ":method", "GET", ":scheme", "https", ":path", "/hello/h2", ":authority", "example.com")
+	client.request(3, "", ":method", "GET", ":scheme", "https", ":path", "/blocking", "x-test", "h2")
+	responses := client.responses(1, 3)
+	assert(t, responses[1].body == "hello example.com")
+	assert(t, responses[3].body == "blocking h2")
+}
+
+func TestListenAndServeTLS(t *testing.T) {
+	_, certPEM, keyPEM := generateCert(t, "example.com")
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	noError(t, os.WriteFile(certFile, certPEM, 0o600))
+	noError(t, os.WriteFile(keyFile, keyPEM, 0o600))
+
+	server := NewServer(h2TestRouter(), ServerOptions{})
+	assert(t, server.ListenAndServeTLS("tcp://127.0.0.1:0", certFile, filepath.Join(dir, "missing.pem")) != nil)
+
+	address := freeAddress(t)
+	go server.ListenAndServeTLS("tcp://"+address, certFile, keyFile)
+	t.Cleanup(func() {
+		server.Shutdown(context.Background())
+	})
+	var conn *tls.Conn
+	for i := 0; i < 100; i++ {
+		var err error
+		conn, err = tls.Dial("tcp", address, &tls.Config{InsecureSkipVerify: true})
+		if err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert(t, conn != nil)
+	defer conn.Close()
+	_, err := conn.Write([]byte("GET /hello/file HTTP/1.1\r\nHost: a\r\n\r\n"))
+	noError(t, err)
+	_, body := readResponse(t, bufio.NewReader(conn))
+	assert(t, body == "hello a")
+}
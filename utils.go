@@ -25,3 +25,38 @@ func CopyBytes(bytes []byte) []byte {
 func CopyString(s string) string {
 	return string(CopyBytes([]byte(s)))
 }
+
+func unhex(c byte) (byte, bool) {
+	switch {
+	case '0' <= c && c <= '9':
+		return c - '0', true
+	case 'a' <= c && c <= 'f':
+		return c - 'a' + 10, true
+	case 'A' <= c && c <= 'F':
+		return c - 'A' + 10, true
+	}
+	return 0, false
+}
+
+// unescapeQuery decodes percent escapes and '+' as space
+// in place and returns the shortened slice.
+// Invalid escapes are kept as they are.
+func unescapeQuery(b []byte) []byte {
+	w := 0
+	for r := 0; r < len(b); r++ {
+		c := b[r]
+		if c == '+' {
+			c = ' '
+		} else if c == '%' && r+2 < len(b) {
+			hi, ok1 := unhex(b[r+1])
+			lo, ok2 := unhex(b[r+2])
+			if ok1 && ok2 {
+				c = hi<<4 | lo
+				r += 2
+			}
+		}
+		b[w] = c
+		w++
+	}
+	return b[:w]
+}
@@ -0,0 +1,457 @@
+package ghttp
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"math"
+	"net"
+	"net/http"
+	"runtime/debug"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+
+	"github.com/panjf2000/gnet/v2"
+)
+
+// WebSocket message types
+const (
+	MessageText   = 1
+	MessageBinary = 2
+)
+
+// WebSocket close codes
+const (
+	CloseNormal          = 1000
+	CloseGoingAway       = 1001
+	CloseProtocolError   = 1002
+	CloseUnsupportedData = 1003
+	CloseNoStatus        = 1005
+	CloseAbnormal        = 1006
+	CloseInvalidPayload  = 1007
+	ClosePolicyViolation = 1008
+	CloseMessageTooBig   = 1009
+	CloseInternalError   = 1011
+)
+
+const (
+	opContinuation = 0x0
+	opText         = 0x1
+	opBinary       = 0x2
+	opClose        = 0x8
+	opPing         = 0x9
+	opPong         = 0xa
+)
+
+// wsCloseTimeout is how long the server waits for the client
+// to answer a close frame before the connection is closed.
+const wsCloseTimeout = 5 * time.Second
+
+var wsGUID = []byte("258EAFA5-E914-47DA-95CA-C5AB0DC85B11")
+
+// ErrBlockingUpgrade is returned by Upgrade in blocking handlers.
+var ErrBlockingUpgrade = errors.New("websocket upgrade in blocking handler")
+
+var errFrameProtocol = errors.New("websocket protocol error")
+var errFrameTooBig = errors.New("websocket message too big")
+
+// WebSocketHandler handles the events of a WebSocket connection.
+// The callbacks are called on the I/O loop and must not block,
+// nil callbacks are ignored.
+type WebSocketHandler struct {
+	// OnOpen is called once the handshake response is sent.
+	OnOpen func(ws *WebSocket)
+	// OnMessage is called for every complete message.
+	// The data is only valid until the callback returns.
+	OnMessage func(ws *WebSocket, messageType int, data []byte)
+	// OnClose is called when the connection is closed. The code is
+	// CloseAbnormal if the connection closed without a close frame.
+	OnClose func(ws *WebSocket, code int, reason string)
+}
+
+// WebSocket is a WebSocket connection upgraded from an HTTP request.
+// Its methods are safe to use from any goroutine.
+type WebSocket struct {
+	conn    gnet.Conn
+	codec   *httpCodec
+	handler WebSocketHandler
+	context atomic.Value
+	// closeSent is set once a close frame is sent,
+	// no messages may follow it.
+	closeSent atomic.Bool
+	// the fields below are only used on the I/O loop.
+	//
+	// messageType is the type of the fragmented message
+	// collected in message or zero.
+	messageType int
+	message     bytes.Buffer
+	// closed is set if no more frames are read.
+	closed bool
+	code   int
+	reason string
+}
+
+// Upgrade switches the connection of the request to the WebSocket protocol.
+// The handshake is validated and answered with 101 Switching Protocols after
+// the handler returns nil, an HTTPError is returned for invalid handshakes.
+// Headers like Sec-WebSocket-Protocol can be added to the response.
+//
+// Upgrade can't be used by blocking handlers.
+func (r Request) Upgrade(handler WebSocketHandler) error {
+	if r.response.stream != nil || r.stream != nil {
+		return ErrBlockingUpgrade
+	}
+	p := r.parser
+	if p.method != MethodGet || p.version != HTTP1_1 ||
+		!hasToken(p.FindHeader([]byte("Connection")), []byte("upgrade")) ||
+		!hasToken(p.FindHeader([]byte("Upgrade")), []byte("websocket")) {
+		return Error(http.StatusBadRequest, "invalid websocket handshake")
+	}
+	if string(p.FindHeader([]byte("Sec-WebSocket-Version"))) != "13" {
+		return Error(http.StatusUpgradeRequired, "").
+			AddHeader([2]string{"Sec-WebSocket-Version", "13"})
+	}
+	key := p.FindHeader([]byte("Sec-WebSocket-Key"))
+	if decoded, err := base64.StdEncoding.DecodeString(string(key)); err != nil || len(decoded) != 16 {
+		return Error(http.StatusBadRequest, "invalid websocket key")
+	}
+	if !p.keepAlive() {
+		return Error(http.StatusBadRequest, "invalid websocket handshake")
+	}
+	if r.response.close {
+		return Error(http.StatusServiceUnavailable, "")
+	}
+	r.response.Status(http.StatusSwitchingProtocols)
+	r.response.AddHeader([2]string{"Upgrade", "websocket"})
+	r.response.AddHeader([2]string{"Connection", "Upgrade"})
+	r.response.AddHeader([2]string{"Sec-WebSocket-Accept", acceptKey(key)})
+	r.codec.upgrade = &WebSocket{conn: r.conn, codec: r.codec, handler: handler}
+	return nil
+}
+
+func acceptKey(key []byte) string {
+	h := sha1.New()
+	h.Write(key)
+	h.Write(wsGUID)
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// Context returns the value set with SetContext.
+func (ws *WebSocket) Context() any {
+	return ws.context.Load()
+}
+
+// SetContext attaches a value to the connection.
+func (ws *WebSocket) SetContext(value any) {
+	ws.context.Store(value)
+}
+
+// RemoteAddr returns the address of the client.
+func (ws *WebSocket) RemoteAddr() net.Addr {
+	return ws.conn.RemoteAddr()
+}
+
+// WriteMessage sends a message of the type MessageText or MessageBinary.
+// It returns net.ErrClosed after the connection was closed.
+func (ws *WebSocket) WriteMessage(messageType int, data []byte) error {
+	if ws.closeSent.Load() {
+		return net.ErrClosed
+	}
+	return ws.write(byte(messageType), data, nil)
+}
+
+// Ping sends a ping with the data, the client answers with a pong.
+func (ws *WebSocket) Ping(data []byte) error {
+	if ws.closeSent.Load() {
+		return net.ErrClosed
+	}
+	return ws.write(opPing, data, nil)
+}
+
+// Close starts the close handshake with the code and reason.
+// The connection is closed once the client answered
+// or after a timeout.
+func (ws *WebSocket) Close(code int, reason string) error {
+	if !ws.closeSent.CompareAndSwap(false, true) {
+		return net.ErrClosed
+	}
+	return ws.write(opClose, closePayload(code, reason), func(c gnet.Conn) {
+		time.AfterFunc(wsCloseTimeout, func() {
+			c.Close()
+		})
+	})
+}
+
+func closePayload(code int, reason string) []byte {
+	payload := make([]byte, 2, 2+len(reason))
+	binary.BigEndian.PutUint16(payload, uint16(code))
+	return append(payload, reason...)
+}
+
+// write sends a frame, done is called on the I/O loop after it is written.
+func (ws *WebSocket) write(opcode byte, payload []byte, done func(c gnet.Conn)) error {
+	buf := bytePool.Get().(*bytes.Buffer)
+	writeFrame(buf, opcode, payload)
+	err := ws.codec.server.asyncWrite(ws.conn, ws.codec, buf.Bytes(), func(c gnet.Conn, err error) error {
+		buf.Reset()
+		bytePool.Put(buf)
+		if done != nil {
+			done(c)
+		}
+		return nil
+	})
+	if err != nil {
+		buf.Reset()
+		bytePool.Put(buf)
+	}
+	return err
+}
+
+// writeFrame writes an unmasked frame which isn't fragmented.
+func writeFrame(into *bytes.Buffer, opcode byte, payload []byte) {
+	into.WriteByte(0x80 | opcode)
+	length := len(payload)
+	switch {
+	case length <= 125:
+		into.WriteByte(byte(length))
+	case length <= math.MaxUint16:
+		into.WriteByte(126)
+		into.Write(binary.BigEndian.AppendUint16(nil, uint16(length)))
+	default:
+		into.WriteByte(127)
+		into.Write(binary.BigEndian.AppendUint64(nil, uint64(length)))
+	}
+	into.Write(payload)
+}
+
+// wsFrame is a frame received from the client.
+type wsFrame struct {
+	fin     bool
+	opcode  byte
+	payload []byte
+}
+
+// parseFrame parses and unmasks a frame sent by the client.
+// It returns the number of bytes of the frame or zero if data
+// doesn't contain a complete frame.
+func parseFrame(data []byte, max int) (wsFrame, int, error) {
+	frame := wsFrame{}
+	if len(data) < 2 {
+		return frame, 0, nil
+	}
+	frame.fin = data[0]&0x80 != 0
+	frame.opcode = data[0] & 0x0f
+	if data[0]&0x70 != 0 || data[1]&0x80 == 0 {
+		// reserved bits without extensions or an unmasked frame.
+		return frame, 0, errFrameProtocol
+	}
+	length := uint64(data[1] & 0x7f)
+	offset := 2
+	switch length {
+	case 126:
+		if len(data) < 4 {
+			return frame, 0, nil
+		}
+		length = uint64(binary.BigEndian.Uint16(data[2:]))
+		offset = 4
+	case 127:
+		if len(data) < 10 {
+			return frame, 0, nil
+		}
+		length = binary.BigEndian.Uint64(data[2:])
+		offset = 10
+		if length > math.MaxInt32 {
+			return frame, 0, errFrameTooBig
+		}
+	}
+	if frame.opcode >= opClose && (!frame.fin || length > 125) {
+		return frame, 0, errFrameProtocol
+	}
+	if max > 0 && length > uint64(max) {
+		return frame, 0, errFrameTooBig
+	}
+	end := offset + 4 + int(length)
+	if len(data) < end {
+		return frame, 0, nil
+	}
+	mask := data[offset : offset+4]
+	frame.payload = data[offset+4 : end]
+	for i := range frame.payload {
+		frame.payload[i] ^= mask[i&3]
+	}
+	return frame, end, nil
+}
+
+func (ws *WebSocket) open() {
+	if ws.handler.OnOpen != nil {
+		if !ws.call("OnOpen", func() { ws.handler.OnOpen(ws) }) {
+			ws.fail(CloseInternalError)
+		}
+	}
+}
+
+// call runs a callback of the handler on the event loop. It recovers
+// and logs a panic like Router.serve and reports whether there was none.
+func (ws *WebSocket) call(name string, callback func()) (ok bool) {
+	defer func() {
+		if v := recover(); v != nil {
+			ws.codec.server.options.Logger.Errorf("ghttp: panic in WebSocket %s: %v\n%s", name, v, debug.Stack())
+			ok = false
+		}
+	}()
+	callback()
+	return true
+}
+
+// onTraffic handles the frames received by the connection.
+func (ws *WebSocket) onTraffic(c gnet.Conn) gnet.Action {
+	data, _ := c.Peek(-1)
+	consumed := 0
+	action := gnet.None
+	for !ws.closed {
+		frame, n, err := parseFrame(data[consumed:], ws.codec.server.options.MaxBodySize)
+		if err == errFrameTooBig {
+			ws.fail(CloseMessageTooBig)
+			break
+		}
+		if err != nil {
+			ws.fail(CloseProtocolError)
+			break
+		}
+		if n == 0 {
+			break
+		}
+		consumed += n
+		action = ws.handleFrame(frame)
+	}
+	if ws.closed {
+		// frames after a close frame are ignored.
+		consumed = c.InboundBuffered()
+	}
+	if consumed > 0 {
+		c.Discard(consumed)
+	}
+	return action
+}
+
+func (ws *WebSocket) handleFrame(frame wsFrame) gnet.Action {
+	switch frame.opcode {
+	case opText, opBinary:
+		if ws.messageType != 0 {
+			ws.fail(CloseProtocolError)
+			break
+		}
+		if frame.fin {
+			ws.deliver(int(frame.opcode), frame.payload)
+			break
+		}
+		ws.messageType = int(frame.opcode)
+		ws.message.Write(frame.payload)
+	case opContinuation:
+		if ws.messageType == 0 {
+			ws.fail(CloseProtocolError)
+			break
+		}
+		ws.message.Write(frame.payload)
+		if max := ws.codec.server.options.MaxBodySize; max > 0 && ws.message.Len() > max {
+			ws.fail(CloseMessageTooBig)
+			break
+		}
+		if frame.fin {
+			ws.deliver(ws.messageType, ws.message.Bytes())
+			ws.messageType = 0
+			ws.message.Reset()
+		}
+	case opPing:
+		if !ws.closeSent.Load() {
+			ws.write(opPong, frame.payload, nil)
+		}
+	case opPong:
+	case opClose:
+		return ws.receiveClose(frame.payload)
+	default:
+		ws.fail(CloseProtocolError)
+	}
+	return gnet.None
+}
+
+func (ws *WebSocket) deliver(messageType int, data []byte) {
+	if messageType == MessageText && !utf8.Valid(data) {
+		ws.fail(CloseInvalidPayload)
+		return
+	}
+	if ws.handler.OnMessage != nil {
+		if !ws.call("OnMessage", func() { ws.handler.OnMessage(ws, messageType, data) }) {
+			ws.fail(CloseInternalError)
+		}
+	}
+}
+
+// receiveClose answers a close frame of the client.
+func (ws *WebSocket) receiveClose(payload []byte) gnet.Action {
+	ws.closed = true
+	ws.code = CloseNoStatus
+	if len(payload) == 1 {
+		ws.fail(CloseProtocolError)
+		return gnet.None
+	}
+	if len(payload) >= 2 {
+		ws.code = int(binary.BigEndian.Uint16(payload))
+		ws.reason = string(payload[2:])
+		if !validCloseCode(ws.code) || !utf8.ValidString(ws.reason) {
+			ws.fail(CloseProtocolError)
+			return gnet.None
+		}
+	}
+	if !ws.closeSent.CompareAndSwap(false, true) {
+		// the client answered our close frame.
+		return gnet.Close
+	}
+	answer := []byte{}
+	if ws.code != CloseNoStatus {
+		answer = closePayload(ws.code, "")
+	}
+	ws.write(opClose, answer, func(c gnet.Conn) {
+		c.Close()
+	})
+	return gnet.None
+}
+
+func validCloseCode(code int) bool {
+	switch {
+	case code >= 3000 && code <= 4999:
+		return true
+	case code < 1000 || code > 1014:
+		return false
+	}
+	return code != 1004 && code != CloseNoStatus && code != CloseAbnormal
+}
+
+// fail closes the connection because of an error
+// without waiting for the client.
+func (ws *WebSocket) fail(code int) {
+	ws.closed = true
+	ws.code = code
+	if !ws.closeSent.CompareAndSwap(false, true) {
+		ws.conn.Close()
+		return
+	}
+	ws.write(opClose, closePayload(code, ""), func(c gnet.Conn) {
+		c.Close()
+	})
+}
+
+// onClose is called when the connection is closed.
+func (ws *WebSocket) onClose() {
+	code := ws.code
+	if code == 0 {
+		code = CloseAbnormal
+	}
+	if ws.handler.OnClose != nil {
+		// the connection is closed already.
+		ws.call("OnClose", func() { ws.handler.OnClose(ws, code, ws.reason) })
+	}
+}
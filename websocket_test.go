@@ -0,0 +1,222 @@
+package ghttp
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func maskedFrame(fin bool, opcode byte, payload []byte) []byte {
+	frame := []byte{opcode, 0x80}
+	if fin {
+		frame[0] |= 0x80
+	}
+	switch {
+	case len(payload) <= 125:
+		frame[1] |= byte(len(payload))
+	case len(payload) <= 0xffff:
+		frame[1] |= 126
+		frame = binary.BigEndian.AppendUint16(frame, uint16(len(payload)))
+	default:
+		frame[1] |= 127
+		frame = binary.BigEndian.AppendUint64(frame, uint64(len(payload)))
+	}
+	mask := []byte{1, 2, 3, 4}
+	frame = append(frame, mask...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i&3])
+	}
+	return frame
+}
+
+func readFrame(t *testing.T, reader *bufio.Reader) (byte, []byte) {
+	t.Helper()
+	header := make([]byte, 2)
+	_, err := io.ReadFull(reader, header)
+	noError(t, err)
+	length := int(header[1] & 0x7f)
+	if length == 126 {
+		ext := make([]byte, 2)
+		_, err = io.ReadFull(reader, ext)
+		noError(t, err)
+		length = int(binary.BigEndian.Uint16(ext))
+	}
+	payload := make([]byte, length)
+	_, err = io.ReadFull(reader, payload)
+	noError(t, err)
+	return header[0] & 0x0f, payload
+}
+
+func TestParseFrame(t *testing.T) {
+	payload := bytes.Repeat([]byte("x"), 300)
+	frame := maskedFrame(true, opBinary, payload)
+
+	_, n, err := parseFrame(frame[:3], 0)
+	noError(t, err)
+	assert(t, n == 0)
+
+	parsed, n, err := parseFrame(append([]byte{}, frame...), 0)
+	noError(t, err)
+	assert(t, n == len(frame) && parsed.fin && parsed.opcode == opBinary)
+	assert(t, bytes.Equal(parsed.payload, payload))
+
+	_, _, err = parseFrame(frame, 100)
+	assert(t, err == errFrameTooBig)
+
+	unmasked := []byte{0x81, 0x01, 'a'}
+	_, _, err = parseFrame(unmasked, 0)
+	assert(t, err == errFrameProtocol)
+
+	_, _, err = parseFrame(maskedFrame(false, opPing, nil), 0)
+	assert(t, err == errFrameProtocol)
+}
+
+func TestWebSocket(t *testing.T) {
+	router := NewRouter()
+	closed := make(chan int, 1)
+	router.Register("@GET/ws", func(req Request, res *Response) error {
+		return req.Upgrade(WebSocketHandler{
+			OnOpen: func(ws *WebSocket) {
+				ws.WriteMessage(MessageText, []byte("hello"))
+			},
+			OnMessage: func(ws *WebSocket, messageType int, data []byte) {
+				if string(data) == "bye" {
+					ws.Close(CloseNormal, "bye")
+					return
+				}
+				ws.WriteMessage(messageType, data)
+			},
+			OnClose: func(ws *WebSocket, code int, reason string) {
+				closed <- code
+			},
+		})
+	})
+	address := startTestServer(t, router)
+
+	conn, err := net.Dial("tcp", address)
+	noError(t, err)
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = conn.Write([]byte("GET /ws HTTP/1.1\r\nHost: test\r\nUpgrade: websocket\r\n" +
+		"Connection: keep-alive, Upgrade\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n" +
+		"Sec-WebSocket-Version: 13\r\n\r\n"))
+	noError(t, err)
+	reader := bufio.NewReader(conn)
+	res, err := http.ReadResponse(reader, nil)
+	noError(t, err)
+	assert(t, res.StatusCode == http.StatusSwitchingProtocols)
+	assert(t, res.Header.Get("Sec-WebSocket-Accept") == "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=")
+	assert(t, res.Header.Get("Content-Length") == "")
+
+	opcode, payload := readFrame(t, reader)
+	assert(t, opcode == opText && string(payload) == "hello")
+
+	big := bytes.Repeat([]byte("y"), 1000)
+	frames := append(maskedFrame(false, opBinary, big[:500]), maskedFrame(true, opPing, []byte("p"))...)
+	frames = append(frames, maskedFrame(true, opContinuation, big[500:])...)
+	_, err = conn.Write(frames)
+	noError(t, err)
+	opcode, payload = readFrame(t, reader)
+	assert(t, opcode == opPong && string(payload) == "p")
+	opcode, payload = readFrame(t, reader)
+	assert(t, opcode == opBinary && bytes.Equal(payload, big))
+
+	_, err = conn.Write(maskedFrame(true, opText, []byte("bye")))
+	noError(t, err)
+	opcode, payload = readFrame(t, reader)
+	assert(t, opcode == opClose && binary.BigEndian.Uint16(payload) == CloseNormal)
+	assert(t, string(payload[2:]) == "bye")
+	_, err = conn.Write(maskedFrame(true, opClose, payload[:2]))
+	noError(t, err)
+	_, err = reader.ReadByte()
+	assert(t, err == io.EOF)
+	select {
+	case code := <-closed:
+		assert(t, code == CloseNormal)
+	case <-time.After(5 * time.Second):
+		t.Fatal("OnClose was not called")
+	}
+}
+
+func TestWebSocketPanic(t *testing.T) {
+	router := NewRouter()
+	closed := make(chan int, 1)
+	router.Register("@GET/ws", func(req Request, res *Response) error {
+		return req.Upgrade(WebSocketHandler{
+			OnMessage: func(ws *WebSocket, messageType int, data []byte) {
+				panic("message")
+			},
+			OnClose: func(ws *WebSocket, code int, reason string) {
+				closed <- code
+				panic("close")
+			},
+		})
+	})
+	router.Register("@GET/", func(req Request, res *Response) error {
+		res.WriteString("alive")
+		return nil
+	})
+	address := startTestServer(t, router)
+
+	conn, err := net.Dial("tcp", address)
+	noError(t, err)
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = conn.Write([]byte("GET /ws HTTP/1.1\r\nHost: test\r\nUpgrade: websocket\r\n" +
+		"Connection: Upgrade\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n" +
+		"Sec-WebSocket-Version: 13\r\n\r\n"))
+	noError(t, err)
+	reader := bufio.NewReader(conn)
+	res, err := http.ReadResponse(reader, nil)
+	noError(t, err)
+	assert(t, res.StatusCode == http.StatusSwitchingProtocols)
+
+	_, err = conn.Write(maskedFrame(true, opText, []byte("hi")))
+	noError(t, err)
+	opcode, payload := readFrame(t, reader)
+	assert(t, opcode == opClose && binary.BigEndian.Uint16(payload) == CloseInternalError)
+	_, err = reader.ReadByte()
+	assert(t, err == io.EOF)
+	select {
+	case code := <-closed:
+		assert(t, code == CloseInternalError)
+	case <-time.After(5 * time.Second):
+		t.Fatal("OnClose was not called")
+	}
+
+	// the server survived both panics.
+	conn, err = net.Dial("tcp", address)
+	noError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+	noError(t, err)
+	_, body := readResponse(t, bufio.NewReader(conn))
+	assert(t, body == "alive")
+}
+
+func TestWebSocketInvalidHandshake(t *testing.T) {
+	router := NewRouter()
+	router.Register("@GET/ws", func(req Request, res *Response) error {
+		return req.Upgrade(WebSocketHandler{})
+	})
+	address := startTestServer(t, router)
+
+	conn, err := net.Dial("tcp", address)
+	noError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("GET /ws HTTP/1.1\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 8\r\n\r\n" +
+		"GET /ws HTTP/1.1\r\n\r\n"))
+	noError(t, err)
+	reader := bufio.NewReader(conn)
+	res, _ := readResponse(t, reader)
+	assert(t, res.StatusCode == http.StatusUpgradeRequired)
+	assert(t, res.Header.Get("Sec-WebSocket-Version") == "13")
+	res, _ = readResponse(t, reader)
+	assert(t, res.StatusCode == http.StatusBadRequest)
+}